@@ -0,0 +1,31 @@
+package bloomseq
+
+import (
+	"errors"
+	"github.com/krl/bloomtree/store"
+	"io"
+)
+
+var ErrNotSeq = errors.New("archive does not hold a sequence")
+
+// Export writes every block of a persisted sequence to w as an archive
+func (r BloomSeq) Export(w io.Writer) error {
+	ref, ok := r.value.(treeRef)
+	if !ok {
+		return ErrNotPersisted
+	}
+	return store.Export(w, ref.store, ref.key, store.KindSeq)
+}
+
+// Import puts the blocks of an archive into s and returns the
+// sequence it holds
+func Import(in io.Reader, s store.BlockStore) (BloomSeq, error) {
+	header, err := store.Import(in, s)
+	if err != nil {
+		return BloomSeq{}, err
+	}
+	if header.Kind != store.KindSeq {
+		return BloomSeq{}, ErrNotSeq
+	}
+	return Load(s, header.Root), nil
+}
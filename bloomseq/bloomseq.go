@@ -2,7 +2,7 @@ package bloomseq
 
 import (
 	"fmt"
-	mdag "github.com/ipfs/go-ipfs/merkledag"
+	"github.com/krl/bloomtree/store"
 	// . "github.com/krl/bloomtree/value"
 )
 
@@ -10,6 +10,10 @@ type BloomSeq struct {
 	value tree
 }
 
+// GetLeavesDepth returns the depth of every leaf, loading the whole
+// sequence.
+//
+// Deprecated: use Stats.
 func (r BloomSeq) GetLeavesDepth() []int {
 	if r.value == nil {
 		return []int{}
@@ -17,6 +21,7 @@ func (r BloomSeq) GetLeavesDepth() []int {
 	return r.value.getLeavesDepth(0)
 }
 
+// Deprecated: use Stats.
 func (r BloomSeq) CountUnreferencedNodes() int {
 	if r.value != nil {
 		return r.value.countUnreferencedNodes()
@@ -25,6 +30,7 @@ func (r BloomSeq) CountUnreferencedNodes() int {
 	return 0
 }
 
+// Deprecated: use Stats or Verify.
 func (r BloomSeq) InvariantAllLeavesAtSameDepth() bool {
 	depths := r.GetLeavesDepth()
 	track := 0
@@ -53,7 +59,7 @@ func (r BloomSeq) Count() uint64 {
 // the logical value will still be immutable, and all non-test
 // functions will report the same value
 func (r *BloomSeq) GetAt(i uint64) ([]byte, error) {
-	if i > r.Count() {
+	if i >= r.Count() {
 		return nil, fmt.Errorf("Index out of bounds")
 	}
 
@@ -66,7 +72,7 @@ func (r *BloomSeq) GetAt(i uint64) ([]byte, error) {
 }
 
 func (r BloomSeq) RemoveAt(i uint64) BloomSeq {
-	if i > r.Count()-1 {
+	if i >= r.Count() {
 		panic("Index out of bounds")
 	}
 
@@ -98,10 +104,24 @@ func (r BloomSeq) InsertAt(i uint64, s []byte) BloomSeq {
 
 // Persistance
 
-func (r BloomSeq) Persist(dserv mdag.DAGService) BloomSeq {
+func (r BloomSeq) Persist(s store.BlockStore) BloomSeq {
 	if r.value != nil {
-		return BloomSeq{value: r.value.persist(dserv)}
+		return BloomSeq{value: r.value.persist(s)}
 	} else {
 		return BloomSeq{}
 	}
 }
+
+// Load returns the sequence persisted with the given root key
+func Load(s store.BlockStore, root store.Key) BloomSeq {
+	return BloomSeq{value: treeRef{key: root, store: s}}
+}
+
+// Root returns the key of a persisted sequence, or an empty key if the
+// sequence is empty or has changes that are not persisted
+func (r BloomSeq) Root() store.Key {
+	if ref, ok := r.value.(treeRef); ok {
+		return ref.key
+	}
+	return ""
+}
@@ -8,9 +8,17 @@ import (
 	"github.com/ipfs/go-ipfs/exchange/offline"
 	mdag "github.com/ipfs/go-ipfs/merkledag"
 
+	"bytes"
 	"encoding/binary"
+	"encoding/json"
+	"fmt"
 	"math/rand"
+	"strings"
 	"testing"
+
+	proto "code.google.com/p/goprotobuf/proto"
+	pb "github.com/krl/bloomtree/bloomseq/pb"
+	"github.com/krl/bloomtree/store"
 )
 
 func getMockDagServ(t testing.TB) mdag.DAGService {
@@ -127,6 +135,15 @@ func TestGet(t *testing.T) {
 			t.Fatalf("Got %v from index %v, expected %v", res, i, -i-1+count)
 		}
 	}
+
+	if _, err := tree.GetAt(count); err == nil {
+		t.Fatal("Should not get past the end")
+	}
+
+	empty := BloomSeq{}
+	if _, err := empty.GetAt(0); err == nil {
+		t.Fatal("Should not get from an empty sequence")
+	}
 }
 
 func TestGetAddingFromEnd(t *testing.T) {
@@ -289,11 +306,11 @@ func BenchmarkAdd(*testing.B) {
 // persistance tests
 
 func TestPersistEmtpyRoot(t *testing.T) {
-	dserv := getMockDagServ(t)
+	bstore := store.NewMemoryStore()
 
 	tree := BloomSeq{}
 
-	persisted := tree.Persist(dserv)
+	persisted := tree.Persist(bstore)
 
 	if tree != persisted {
 		t.Fatal("Did not get same BloomSeq back")
@@ -306,12 +323,12 @@ func TestPersistEmtpyRoot(t *testing.T) {
 }
 
 func TestPersistSingletonRoot(t *testing.T) {
-	dserv := getMockDagServ(t)
+	bstore := store.NewMemoryStore()
 
 	tree := BloomSeq{}
 	tree = tree.InsertAt(0, []byte("leafy!"))
 
-	persisted := tree.Persist(dserv)
+	persisted := tree.Persist(bstore)
 
 	if tree.Count() != persisted.Count() {
 		t.Fatal("Count differs between trees")
@@ -327,7 +344,7 @@ func TestPersistSingletonRoot(t *testing.T) {
 
 func PersistAndGetAllValues(t *testing.T) {
 
-	dserv := getMockDagServ(t)
+	bstore := store.NewMemoryStore()
 
 	var count uint64 = 100
 	tree := BloomSeq{}
@@ -337,7 +354,7 @@ func PersistAndGetAllValues(t *testing.T) {
 		tree = tree.InsertAt(0, BytesFromInt(i))
 	}
 
-	tree = tree.Persist(dserv)
+	tree = tree.Persist(bstore)
 
 	for i = 0; i < count; i++ {
 		res, _ := tree.GetAt(i)
@@ -350,7 +367,7 @@ func PersistAndGetAllValues(t *testing.T) {
 
 func TestPersistReplacingRoot(t *testing.T) {
 
-	dserv := getMockDagServ(t)
+	bstore := store.NewMemoryStore()
 
 	var count uint64 = 100
 	tree := BloomSeq{}
@@ -359,7 +376,7 @@ func TestPersistReplacingRoot(t *testing.T) {
 	for i = 0; i < count; i++ {
 
 		// persist at each step
-		tree = tree.Persist(dserv)
+		tree = tree.Persist(bstore)
 		res := tree.Count()
 
 		if res != i {
@@ -371,7 +388,7 @@ func TestPersistReplacingRoot(t *testing.T) {
 
 func TestPersistAndGetFirstValue(t *testing.T) {
 
-	dserv := getMockDagServ(t)
+	bstore := store.NewDAGStore(getMockDagServ(t))
 
 	var count uint64 = 100
 	tree := BloomSeq{}
@@ -383,7 +400,7 @@ func TestPersistAndGetFirstValue(t *testing.T) {
 
 	// persist and insert at beginning
 
-	tree = tree.Persist(dserv)
+	tree = tree.Persist(bstore)
 
 	if tree.CountUnreferencedNodes() != 1 {
 		t.Fatal("dereference fail")
@@ -402,7 +419,7 @@ func TestPersistAndGetFirstValue(t *testing.T) {
 
 func TestPersistAndGetAllValues(t *testing.T) {
 
-	dserv := getMockDagServ(t)
+	bstore := store.NewMemoryStore()
 
 	var count uint64 = 100
 	tree := BloomSeq{}
@@ -414,7 +431,7 @@ func TestPersistAndGetAllValues(t *testing.T) {
 
 	// persist and insert at beginning
 
-	tree = tree.Persist(dserv)
+	tree = tree.Persist(bstore)
 
 	if tree.CountUnreferencedNodes() != 1 {
 		t.Fatal("dereference fail")
@@ -430,3 +447,508 @@ func TestPersistAndGetAllValues(t *testing.T) {
 		t.Fatal("Should have all nodes in memory")
 	}
 }
+
+func TestRepack(t *testing.T) {
+
+	bstore := store.NewMemoryStore()
+
+	var count uint64 = 100
+	tree := BloomSeq{}
+
+	var i uint64
+	for i = 0; i < count; i++ {
+		tree = tree.InsertAt(i, BytesFromInt(i))
+	}
+
+	tree = tree.Persist(bstore)
+
+	repacked, report := tree.Repack(bstore)
+
+	if repacked.Count() != count {
+		t.Fatalf("Should have count() equal to %v, is %v", count, repacked.Count())
+	}
+
+	if !repacked.InvariantAllLeavesAtSameDepth() {
+		t.Fatal("invariant all leaves at same depth broken")
+	}
+
+	if report.After.Blocks > report.Before.Blocks {
+		t.Fatalf("Repacked tree uses more blocks (%v) than before (%v)",
+			report.After.Blocks, report.Before.Blocks)
+	}
+
+	if report.After.Node2s > 2*report.After.Depth {
+		t.Fatalf("Should have at most 2 node2s per level, got %v over %v levels",
+			report.After.Node2s, report.After.Depth)
+	}
+
+	for i = 0; i < count; i++ {
+		res, _ := repacked.GetAt(i)
+		if IntFromBytes(res) != i {
+			t.Fatalf("Got %v from index %v, expected %v", IntFromBytes(res), i, i)
+		}
+	}
+}
+
+func TestDiff(t *testing.T) {
+
+	bstore := store.NewMemoryStore()
+
+	var count uint64 = 100
+	old := BloomSeq{}
+
+	var i uint64
+	for i = 0; i < count; i++ {
+		old = old.InsertAt(i, BytesFromInt(i))
+	}
+
+	old = old.Persist(bstore)
+
+	new := old.InsertAt(10, []byte("inserted"))
+	new = new.RemoveAt(50)
+	new = new.Persist(bstore)
+
+	ranges := Diff(old, new)
+
+	expected := []Range{
+		{OldStart: 10, OldEnd: 10, NewStart: 10, NewEnd: 11},
+		{OldStart: 49, OldEnd: 50, NewStart: 50, NewEnd: 50},
+	}
+
+	if len(ranges) != len(expected) {
+		t.Fatalf("Should have %v ranges, got %v", expected, ranges)
+	}
+
+	for i := range expected {
+		if ranges[i] != expected[i] {
+			t.Fatalf("Should have %v ranges, got %v", expected, ranges)
+		}
+	}
+
+	if len(Diff(new, new)) != 0 {
+		t.Fatal("Should not find differences between equal versions")
+	}
+}
+
+func TestPersistAndRemove(t *testing.T) {
+
+	bstore := store.NewMemoryStore()
+
+	var count uint64 = 100
+	tree := BloomSeq{}
+
+	var i uint64
+	for i = 0; i < count; i++ {
+		tree = tree.InsertAt(i, BytesFromInt(i))
+	}
+
+	// removing needs to load the siblings it steals from
+	tree = tree.Persist(bstore)
+
+	for i = 0; i < count; i++ {
+		tree = tree.RemoveAt(0)
+
+		if tree.Count() != count-i-1 {
+			t.Fatalf("Should have count() equal to %v, is %v", count-i-1, tree.Count())
+		}
+		if !tree.InvariantAllLeavesAtSameDepth() {
+			t.Fatal("invariant all leaves at same depth broken")
+		}
+	}
+}
+
+func TestGC(t *testing.T) {
+
+	bstore := store.NewMemoryStore()
+
+	var count uint64 = 100
+	tree := BloomSeq{}
+
+	var i uint64
+	for i = 0; i < count; i++ {
+		tree = tree.InsertAt(i, BytesFromInt(i))
+		tree = tree.Persist(bstore)
+	}
+
+	live := map[store.Key]bool{}
+
+	keys, errs := store.Reachable(bstore, tree.Root())
+	for key := range keys {
+		live[key] = true
+	}
+
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := store.GC(bstore, []store.Key{tree.Root()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	left, _ := bstore.Keys()
+	if len(left) != len(live) {
+		t.Fatalf("Should keep %v reachable blocks, kept %v", len(live), len(left))
+	}
+
+	tree = Load(bstore, tree.Root())
+
+	for i = 0; i < count; i++ {
+		res, _ := tree.GetAt(i)
+		if IntFromBytes(res) != i {
+			t.Fatalf("Got %v from index %v, expected %v", IntFromBytes(res), i, i)
+		}
+	}
+}
+
+func TestProveAt(t *testing.T) {
+
+	bstore := store.NewMemoryStore()
+
+	var count uint64 = 100
+	tree := BloomSeq{}
+
+	var i uint64
+	for i = 0; i < count; i++ {
+		tree = tree.InsertAt(i, BytesFromInt(i))
+	}
+
+	_, _, err := tree.ProveAt(0)
+	if err != ErrNotPersisted {
+		t.Fatal("Should not prove values of a sequence that is not persisted")
+	}
+
+	tree = tree.Persist(bstore)
+	root := tree.Root()
+
+	for i = 0; i < count; i++ {
+		value, proof, err := tree.ProveAt(i)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		verified, err := VerifyAt(root, i, proof)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if IntFromBytes(verified) != i || IntFromBytes(value) != i {
+			t.Fatalf("Got %v from index %v, expected %v", IntFromBytes(verified), i, i)
+		}
+	}
+
+	_, proof, _ := tree.ProveAt(10)
+
+	if _, err := VerifyAt(root, 90, proof); err == nil {
+		t.Fatal("Proof should not verify another index")
+	}
+
+	// tamper with a sibling on the path
+	last := proof.Levels[len(proof.Levels)-1]
+	for j := range last {
+		last[j] = append([]byte{}, last[j]...)
+		last[j][len(last[j])-1]++
+	}
+
+	if _, err := VerifyAt(root, 10, proof); err == nil {
+		t.Fatal("Tampered proof should not verify")
+	}
+}
+
+func TestExportImport(t *testing.T) {
+	src := store.NewDAGStore(getMockDagServ(t))
+
+	var count uint64 = 100
+	tree := BloomSeq{}
+
+	var i uint64
+	for i = 0; i < count; i++ {
+		tree = tree.InsertAt(i, BytesFromInt(i))
+	}
+
+	var archive bytes.Buffer
+
+	if tree.Export(&archive) != ErrNotPersisted {
+		t.Fatal("Should not export a sequence that is not persisted")
+	}
+
+	tree = tree.Persist(src)
+
+	err := tree.Export(&archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// corrupt the last block, before the three byte trailer
+	corrupt := append([]byte{}, archive.Bytes()...)
+	corrupt[len(corrupt)-4] ^= 1
+
+	_, err = Import(bytes.NewReader(corrupt), store.NewMemoryStore())
+	if err != store.ErrHashMismatch {
+		t.Fatal("Should refuse blocks that don't match their key")
+	}
+
+	dst := store.NewMemoryStore()
+
+	imported, err := Import(&archive, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if imported.Root() != tree.Root() {
+		t.Fatal("Should import the root of the archive")
+	}
+
+	for i = 0; i < count; i++ {
+		value, err := imported.GetAt(i)
+		if err != nil || !bytes.Equal(value, BytesFromInt(i)) {
+			t.Fatalf("Should read %v from the imported sequence", i)
+		}
+	}
+}
+
+func TestVerify(t *testing.T) {
+	bstore := store.NewMemoryStore()
+
+	var count uint64 = 100
+	tree := BloomSeq{}
+
+	var i uint64
+	for i = 0; i < count; i++ {
+		tree = tree.InsertAt(i, BytesFromInt(i))
+	}
+
+	tree = tree.Persist(bstore)
+
+	report := Verify(bstore, tree.Root())
+	if !report.OK() || report.Blocks == 0 {
+		t.Fatalf("Should verify a persisted sequence, got %v", report.Violations)
+	}
+
+	leaf := BloomSeq{}.InsertAt(0, []byte("leaf")).Persist(bstore)
+
+	put := func(count uint64, links ...store.Key) store.Key {
+		message := &pb.Tree{
+			Type:  pb.Tree_Node2.Enum(),
+			Count: proto.Uint64(count),
+		}
+		for _, link := range links {
+			message.Links = append(message.Links, []byte(link))
+		}
+		block, _ := proto.Marshal(message)
+		key, _ := bstore.Put(block)
+		return key
+	}
+
+	// uneven and miscounted
+	report = Verify(bstore, put(5, tree.Root(), leaf.Root()))
+	if len(report.Violations) != 2 {
+		t.Fatalf("Should find 2 violations, found %v", report.Violations)
+	}
+
+	missing := store.Hash([]byte("missing"))
+
+	report = Verify(bstore, put(2, leaf.Root(), missing))
+	if len(report.Violations) != 1 || report.Violations[0].Key != missing {
+		t.Fatalf("Should report the missing block, got %v", report.Violations)
+	}
+
+	// both children are checked
+	other := store.Hash([]byte("also missing"))
+
+	report = Verify(bstore, put(2, missing, other))
+	if len(report.Violations) != 2 {
+		t.Fatalf("Should report both missing blocks, got %v", report.Violations)
+	}
+}
+
+type dumped struct {
+	Type     string
+	Count    uint64
+	Children []dumped
+}
+
+func (d dumped) leaves() int {
+	if d.Type == "leaf" {
+		return 1
+	}
+	leaves := 0
+	for _, c := range d.Children {
+		leaves += c.leaves()
+	}
+	return leaves
+}
+
+func TestDump(t *testing.T) {
+	bstore := store.NewMemoryStore()
+
+	var count uint64 = 100
+	tree := BloomSeq{}
+
+	var i uint64
+	for i = 0; i < count; i++ {
+		tree = tree.InsertAt(i, BytesFromInt(i))
+	}
+
+	tree = tree.Persist(bstore).InsertAt(0, []byte("first"))
+
+	var out bytes.Buffer
+
+	err := tree.DumpJSON(&out, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var full dumped
+	json.Unmarshal(out.Bytes(), &full)
+
+	if full.Count != count+1 || full.leaves() != int(count+1) {
+		t.Fatal("Should dump every leaf")
+	}
+
+	out.Reset()
+	tree.DumpJSON(&out, 1)
+
+	var shallow dumped
+	json.Unmarshal(out.Bytes(), &shallow)
+
+	refs := 0
+	for _, c := range shallow.Children {
+		if len(c.Children) != 0 {
+			t.Fatal("Should stop at the depth limit")
+		}
+		if c.Type == "treeRef" {
+			refs++
+		}
+	}
+
+	// only the path to the new value is loaded
+	if refs != len(shallow.Children)-1 {
+		t.Fatalf("Should not load references past the limit, got %v", shallow)
+	}
+
+	out.Reset()
+	tree.DumpDOT(&out, -1)
+
+	nodes := strings.Count(out.String(), "[label=")
+	edges := strings.Count(out.String(), "->")
+
+	if nodes == 0 || edges != nodes-1 {
+		t.Fatalf("Should dump a tree, got %v nodes and %v edges", nodes, edges)
+	}
+}
+
+func TestStats(t *testing.T) {
+	bstore := store.NewMemoryStore()
+
+	var count uint64 = 100
+	tree := BloomSeq{}
+
+	var i uint64
+	for i = 0; i < count; i++ {
+		tree = tree.InsertAt(i, BytesFromInt(i))
+	}
+
+	stats, _ := tree.Stats(false)
+
+	if stats.Leaves() != int(count) || stats.Nodes["leaf"] != int(count) {
+		t.Fatal("Should count every leaf")
+	}
+
+	if len(stats.LeafDepths) == 0 || stats.LeafDepths[len(stats.LeafDepths)-1] != int(count) {
+		t.Fatal("Should have all leaves at the same depth")
+	}
+
+	if stats.Unloaded != 0 || stats.Blocks != 0 {
+		t.Fatal("Should not read blocks of a sequence in memory")
+	}
+
+	tree = tree.Persist(bstore).InsertAt(0, []byte("first"))
+
+	shallow, _ := tree.Stats(true)
+
+	// the new leaf and the one it was inserted next to
+	if shallow.Blocks != 0 || shallow.Unloaded == 0 || shallow.Leaves() != 2 {
+		t.Fatalf("Should stop at unloaded nodes, got %v", shallow)
+	}
+
+	full, err := tree.Stats(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if full.Leaves() != int(count+1) || full.Blocks != full.Unloaded {
+		t.Fatalf("Should read every unloaded node, got %v", full)
+	}
+
+	if full.AvgBlockSize() <= 0 {
+		t.Fatal("Should measure block sizes")
+	}
+}
+
+// writes a tree block the way trees were persisted before blocks held
+// the keys of their children
+func putLegacy(t *testing.T, dserv mdag.DAGService, message *pb.Tree, children ...*mdag.Link) *mdag.Link {
+	data, _ := proto.Marshal(message)
+
+	node := &mdag.Node{Data: data}
+	for i, c := range children {
+		node.AddRawLink(fmt.Sprint(i), c)
+	}
+
+	_, err := dserv.Add(node)
+	if err != nil {
+		t.Fatal(err)
+	}
+	link, err := mdag.MakeLink(node)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return link
+}
+
+func TestLegacyDAGLinks(t *testing.T) {
+	dserv := getMockDagServ(t)
+
+	leafType, node2Type := pb.Tree_Leaf, pb.Tree_Node2
+
+	leaves := []*mdag.Link{}
+	for _, data := range []string{"wonk", "donk"} {
+		leaves = append(leaves, putLegacy(t, dserv, &pb.Tree{
+			Type:  &leafType,
+			Count: proto.Uint64(1),
+			Data:  []byte(data),
+		}))
+	}
+
+	root := putLegacy(t, dserv, &pb.Tree{
+		Type:  &node2Type,
+		Count: proto.Uint64(2),
+	}, leaves...)
+
+	seq := Load(store.NewDAGStore(dserv), store.Key(root.Hash))
+
+	for i, expected := range []string{"wonk", "donk"} {
+		got, err := seq.GetAt(uint64(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != expected {
+			t.Fatalf("Got %q at %v, expected %q", got, i, expected)
+		}
+	}
+	if report := Verify(store.NewDAGStore(dserv), store.Key(root.Hash)); !report.OK() || report.Blocks != 3 {
+		t.Fatalf("Should verify a legacy tree, got %v", report)
+	}
+
+	var out bytes.Buffer
+	Load(store.NewDAGStore(dserv), store.Key(root.Hash)).DumpJSON(&out, -1)
+	if strings.Count(out.String(), `"leaf"`) != 2 {
+		t.Fatalf("Should dump the leaves of a legacy tree, got %s", out.Bytes())
+	}
+
+	seq = Load(store.NewDAGStore(dserv), store.Key(root.Hash))
+	if _, _, err := seq.ProveAt(0); err != ErrLegacyProof {
+		t.Fatalf("Should refuse to prove values of a legacy tree, got %v", err)
+	}
+}
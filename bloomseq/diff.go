@@ -0,0 +1,190 @@
+package bloomseq
+
+// Range is a changed part of a sequence, the values at
+// [OldStart, OldEnd) in the old sequence were replaced by the values
+// at [NewStart, NewEnd) in the new one
+type Range struct {
+	OldStart uint64
+	OldEnd   uint64
+	NewStart uint64
+	NewEnd   uint64
+}
+
+// above this many comparisons, the differing middle part of the
+// sequences is reported as a single range
+const maxDiffCells = 1 << 20
+
+func refKey(t tree) (string, bool) {
+	if r, ok := t.(treeRef); ok {
+		return string(r.key), true
+	}
+	return "", false
+}
+
+func refKeys(items []tree) map[string]bool {
+	keys := map[string]bool{}
+	for _, t := range items {
+		if k, ok := refKey(t); ok {
+			keys[k] = true
+		}
+	}
+	return keys
+}
+
+// expand replaces every subtree not shared with the other side by its
+// children, loading it if needed
+func expand(items []tree, other map[string]bool) ([]tree, bool) {
+	expanded := make([]tree, 0, len(items))
+	changed := false
+
+	for _, t := range items {
+		if k, ok := refKey(t); ok {
+			if other[k] {
+				expanded = append(expanded, t)
+				continue
+			}
+			t = t.(treeRef).read()
+			changed = true
+		}
+
+		switch n := t.(type) {
+		case node2:
+			expanded = append(expanded, n.children...)
+			changed = true
+		case node3:
+			expanded = append(expanded, n.children...)
+			changed = true
+		case leaf:
+			expanded = append(expanded, n)
+		}
+	}
+	return expanded, changed
+}
+
+type token struct {
+	key   string
+	count uint64
+}
+
+func tokens(items []tree) []token {
+	toks := make([]token, len(items))
+	for i, t := range items {
+		if k, ok := refKey(t); ok {
+			toks[i] = token{key: "r" + k, count: t.count()}
+		} else {
+			toks[i] = token{key: "l" + string(t.(leaf).Value), count: 1}
+		}
+	}
+	return toks
+}
+
+// Diff compares two versions of a sequence. Subtrees with the same
+// hash in both versions are never loaded.
+func Diff(old, new BloomSeq) []Range {
+	a, b := []tree{}, []tree{}
+	if old.value != nil {
+		a = append(a, old.value)
+	}
+	if new.value != nil {
+		b = append(b, new.value)
+	}
+
+	for {
+		var changedA, changedB bool
+		a, changedA = expand(a, refKeys(b))
+		b, changedB = expand(b, refKeys(a))
+		if !changedA && !changedB {
+			break
+		}
+	}
+
+	return diffTokens(tokens(a), tokens(b))
+}
+
+func sum(toks []token) uint64 {
+	var total uint64
+	for _, t := range toks {
+		total += t.count
+	}
+	return total
+}
+
+// diffTokens finds the ranges between the longest common subsequence
+// of the two token lists
+func diffTokens(a, b []token) []Range {
+	var offsetA, offsetB uint64
+
+	// common prefix
+	for len(a) > 0 && len(b) > 0 && a[0].key == b[0].key {
+		offsetA += a[0].count
+		offsetB += b[0].count
+		a, b = a[1:], b[1:]
+	}
+
+	// common suffix
+	for len(a) > 0 && len(b) > 0 && a[len(a)-1].key == b[len(b)-1].key {
+		a, b = a[:len(a)-1], b[:len(b)-1]
+	}
+
+	if len(a) == 0 && len(b) == 0 {
+		return []Range{}
+	}
+
+	if len(a)*len(b) > maxDiffCells || len(a) == 0 || len(b) == 0 {
+		return []Range{{
+			OldStart: offsetA,
+			OldEnd:   offsetA + sum(a),
+			NewStart: offsetB,
+			NewEnd:   offsetB + sum(b),
+		}}
+	}
+
+	// lcs[i][j] is the length of the lcs of a[i:] and b[j:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i].key == b[j].key {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	ranges := []Range{}
+	current := Range{OldStart: offsetA, OldEnd: offsetA, NewStart: offsetB, NewEnd: offsetB}
+
+	flush := func() {
+		if current.OldEnd != current.OldStart || current.NewEnd != current.NewStart {
+			ranges = append(ranges, current)
+		}
+	}
+
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i].key == b[j].key:
+			flush()
+			current.OldEnd += a[i].count
+			current.NewEnd += b[j].count
+			current.OldStart, current.NewStart = current.OldEnd, current.NewEnd
+			i++
+			j++
+		case j == len(b) || (i < len(a) && lcs[i+1][j] >= lcs[i][j+1]):
+			current.OldEnd += a[i].count
+			i++
+		default:
+			current.NewEnd += b[j].count
+			j++
+		}
+	}
+	flush()
+
+	return ranges
+}
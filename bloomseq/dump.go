@@ -0,0 +1,108 @@
+package bloomseq
+
+import (
+	pb "github.com/krl/bloomtree/bloomseq/pb"
+	"github.com/krl/bloomtree/dump"
+	"github.com/krl/bloomtree/store"
+	"io"
+)
+
+var blockTypes = map[pb.Tree_DataType]string{
+	pb.Tree_Node2: "node2",
+	pb.Tree_Node3: "node3",
+	pb.Tree_Leaf:  "leaf",
+}
+
+// describe dumps the tree t at the given depth, down to the depth
+// limit. A negative limit dumps the whole tree.
+func describe(t tree, depth int, limit int) (dump.Node, error) {
+	var children []tree
+	var d dump.Node
+
+	switch n := t.(type) {
+	case node2:
+		d = dump.Node{Type: "node2", Count: n.count()}
+		children = n.children
+	case node3:
+		d = dump.Node{Type: "node3", Count: n.count()}
+		children = n.children
+	case leaf:
+		d = dump.Node{Type: "leaf", Count: 1, Preview: dump.Preview(n.Value)}
+	case treeRef:
+		if depth == limit {
+			return dump.Node{Type: "treeRef", Key: n.key.String()}, nil
+		}
+
+		// read the block itself, so that children stay unloaded
+		block, err := n.store.Get(n.key)
+		if err != nil {
+			return dump.Node{}, err
+		}
+		message, err := decode(block)
+		if err != nil {
+			return dump.Node{}, err
+		}
+
+		d = dump.Node{
+			Type:  blockTypes[message.GetType()],
+			Key:   n.key.String(),
+			Count: message.GetCount(),
+		}
+		if message.GetType() == pb.Tree_Leaf {
+			d.Preview = dump.Preview(message.Data)
+		}
+		if message.GetType() != pb.Tree_Leaf {
+			links, err := store.TreeLinks(n.store, n.key, message.Links)
+			if err != nil {
+				return dump.Node{}, err
+			}
+			for _, link := range links {
+				children = append(children, treeRef{key: link, store: n.store})
+			}
+		}
+	}
+
+	if depth == limit {
+		return d, nil
+	}
+
+	for _, c := range children {
+		child, err := describe(c, depth+1, limit)
+		if err != nil {
+			return dump.Node{}, err
+		}
+		d.Children = append(d.Children, child)
+	}
+	return d, nil
+}
+
+// describeRoot dumps the sequence down to the depth limit, or returns
+// nil for an empty sequence
+func (r BloomSeq) describeRoot(limit int) (*dump.Node, error) {
+	if r.value == nil {
+		return nil, nil
+	}
+	d, err := describe(r.value, 0, limit)
+	return &d, err
+}
+
+// DumpJSON writes the structure of the sequence to w as JSON, down to
+// the given depth. A negative depth dumps the whole sequence.
+func (r BloomSeq) DumpJSON(w io.Writer, depth int) error {
+	root, err := r.describeRoot(depth)
+	if err != nil {
+		return err
+	}
+	return dump.WriteJSON(w, root)
+}
+
+// DumpDOT writes the structure of the sequence to w as a Graphviz
+// graph, down to the given depth. A negative depth dumps the whole
+// sequence.
+func (r BloomSeq) DumpDOT(w io.Writer, depth int) error {
+	root, err := r.describeRoot(depth)
+	if err != nil {
+		return err
+	}
+	return dump.WriteDOT(w, "bloomseq", root)
+}
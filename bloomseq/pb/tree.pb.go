@@ -56,6 +56,7 @@ type Tree struct {
 	Type             *Tree_DataType `protobuf:"varint,1,req,enum=persist.pb.Tree_DataType" json:"Type,omitempty"`
 	Count            *uint64        `protobuf:"varint,2,req" json:"Count,omitempty"`
 	Data             []byte         `protobuf:"bytes,3,opt" json:"Data,omitempty"`
+	Links            [][]byte       `protobuf:"bytes,8,rep" json:"Links,omitempty"`
 	XXX_unrecognized []byte         `json:"-"`
 }
 
@@ -84,6 +85,13 @@ func (m *Tree) GetData() []byte {
 	return nil
 }
 
+func (m *Tree) GetLinks() [][]byte {
+	if m != nil {
+		return m.Links
+	}
+	return nil
+}
+
 func init() {
 	proto.RegisterEnum("persist.pb.Tree_DataType", Tree_DataType_name, Tree_DataType_value)
 }
@@ -0,0 +1,171 @@
+package bloomseq
+
+import (
+	proto "code.google.com/p/goprotobuf/proto"
+	"errors"
+	"fmt"
+	pb "github.com/krl/bloomtree/bloomseq/pb"
+	"github.com/krl/bloomtree/store"
+)
+
+// Proof shows that a value is at a given index of the sequence with a
+// given root key. It holds the root block and, for every node on the
+// path down to the value, the blocks of all its children, which
+// commit to their counts.
+type Proof struct {
+	Root   []byte
+	Levels [][][]byte
+}
+
+var (
+	ErrNotPersisted = errors.New("sequence is not persisted")
+	// proofs check the links held in blocks, which legacy blocks lack
+	ErrLegacyProof = errors.New("legacy sequences can't be proven, repack them first")
+)
+
+func decode(block []byte) (*pb.Tree, error) {
+	message := new(pb.Tree)
+
+	err := proto.Unmarshal(block, message)
+	if err != nil {
+		return nil, err
+	}
+	return message, nil
+}
+
+// descend picks the child holding index i, given the decoded children,
+// and returns it along with the index within it
+func descend(children []*pb.Tree, i uint64) (int, uint64) {
+	for index, c := range children {
+		if i < c.GetCount() {
+			return index, i
+		}
+		i -= c.GetCount()
+	}
+	return -1, i
+}
+
+// ProveAt returns the value at index i, with a proof that can be
+// checked against the root key of the sequence by VerifyAt
+func (r BloomSeq) ProveAt(i uint64) ([]byte, Proof, error) {
+	ref, ok := r.value.(treeRef)
+	if !ok {
+		return nil, Proof{}, ErrNotPersisted
+	}
+
+	block, err := ref.store.Get(ref.key)
+	if err != nil {
+		return nil, Proof{}, err
+	}
+
+	proof := Proof{Root: block}
+
+	message, err := decode(block)
+	if err != nil {
+		return nil, Proof{}, err
+	}
+
+	if i >= message.GetCount() {
+		return nil, Proof{}, fmt.Errorf("Index out of bounds")
+	}
+
+	for message.GetType() != pb.Tree_Leaf {
+		if len(message.Links) == 0 {
+			return nil, Proof{}, ErrLegacyProof
+		}
+
+		blocks := make([][]byte, len(message.Links))
+		children := make([]*pb.Tree, len(message.Links))
+
+		for j, link := range message.Links {
+			blocks[j], err = ref.store.Get(store.Key(link))
+			if err != nil {
+				return nil, Proof{}, err
+			}
+
+			children[j], err = decode(blocks[j])
+			if err != nil {
+				return nil, Proof{}, err
+			}
+		}
+
+		proof.Levels = append(proof.Levels, blocks)
+
+		var index int
+		index, i = descend(children, i)
+		if index < 0 {
+			return nil, Proof{}, errors.New("counts of children do not add up")
+		}
+		message = children[index]
+	}
+
+	return message.Data, proof, nil
+}
+
+// VerifyAt checks a proof from ProveAt against the root key of a
+// sequence, and returns the value it proves to be at index i
+func VerifyAt(root store.Key, i uint64, proof Proof) ([]byte, error) {
+	if store.Hash(proof.Root) != root {
+		return nil, errors.New("root block does not match the root key")
+	}
+
+	message, err := decode(proof.Root)
+	if err != nil {
+		return nil, err
+	}
+
+	if i >= message.GetCount() {
+		return nil, fmt.Errorf("Index out of bounds")
+	}
+
+	for level := 0; ; level++ {
+		switch message.GetType() {
+		case pb.Tree_Leaf:
+			if level != len(proof.Levels) {
+				return nil, errors.New("proof is longer than the path")
+			}
+			return message.Data, nil
+		case pb.Tree_Node2:
+			if len(message.Links) != 2 {
+				return nil, errors.New("node2 without 2 links")
+			}
+		case pb.Tree_Node3:
+			if len(message.Links) != 3 {
+				return nil, errors.New("node3 without 3 links")
+			}
+		}
+
+		if level >= len(proof.Levels) {
+			return nil, errors.New("proof is shorter than the path")
+		}
+
+		blocks := proof.Levels[level]
+		if len(blocks) != len(message.Links) {
+			return nil, fmt.Errorf("proof has %v children at level %v, node has %v",
+				len(blocks), level, len(message.Links))
+		}
+
+		children := make([]*pb.Tree, len(blocks))
+		var total uint64
+
+		for j, block := range blocks {
+			if store.Hash(block) != store.Key(message.Links[j]) {
+				return nil, fmt.Errorf("child %v at level %v does not match its link", j, level)
+			}
+
+			children[j], err = decode(block)
+			if err != nil {
+				return nil, err
+			}
+			total += children[j].GetCount()
+		}
+
+		if total != message.GetCount() {
+			return nil, fmt.Errorf("counts of children at level %v do not add up", level)
+		}
+
+		var index int
+		index, i = descend(children, i)
+		message = children[index]
+	}
+}
@@ -0,0 +1,107 @@
+package bloomseq
+
+import (
+	"github.com/krl/bloomtree/store"
+)
+
+// Shape is a summary of the structure of a sequence
+type Shape struct {
+	Depth  int
+	Blocks int
+	Node2s int
+	Node3s int
+}
+
+type RepackReport struct {
+	Before Shape
+	After  Shape
+}
+
+// walk visits every node of the tree, loading referenced nodes as
+// needed, records the shape and hands each leaf to fn in order
+func walk(t tree, depth int, shape *Shape, fn func(leaf)) {
+	switch n := t.(type) {
+	case treeRef:
+		walk(n.read(), depth, shape, fn)
+		return
+	case node2:
+		shape.Node2s++
+		for _, c := range n.children {
+			walk(c, depth+1, shape, fn)
+		}
+	case node3:
+		shape.Node3s++
+		for _, c := range n.children {
+			walk(c, depth+1, shape, fn)
+		}
+	case leaf:
+		if depth > shape.Depth {
+			shape.Depth = depth
+		}
+		fn(n)
+	}
+	shape.Blocks++
+}
+
+// pack groups one level of the tree into the parent level, using as
+// many node3s as possible
+func pack(level []tree, s store.BlockStore, shape *Shape) []tree {
+	parents := make([]tree, 0, len(level)/3+1)
+
+	for len(level) > 0 {
+		var take int
+
+		switch len(level) {
+		case 2, 4:
+			take = 2
+		default:
+			take = 3
+		}
+
+		var parent tree
+		if take == 2 {
+			parent = newNode2(level[:take])
+			shape.Node2s++
+		} else {
+			parent = newNode3(level[:take])
+			shape.Node3s++
+		}
+		shape.Blocks++
+
+		parents = append(parents, parent.persist(s))
+		level = level[take:]
+	}
+	return parents
+}
+
+// Repack streams every leaf out of the sequence and writes a
+// replacement tree with the minimal number of nodes to s
+func (r BloomSeq) Repack(s store.BlockStore) (BloomSeq, RepackReport) {
+	report := RepackReport{}
+
+	if r.value == nil {
+		return r, report
+	}
+
+	leaves := make(chan leaf)
+
+	go func() {
+		walk(r.value, 0, &report.Before, func(l leaf) {
+			leaves <- l
+		})
+		close(leaves)
+	}()
+
+	level := []tree{}
+	for l := range leaves {
+		level = append(level, l.persist(s))
+		report.After.Blocks++
+	}
+
+	for len(level) > 1 {
+		level = pack(level, s, &report.After)
+		report.After.Depth++
+	}
+
+	return BloomSeq{value: level[0]}, report
+}
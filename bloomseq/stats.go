@@ -0,0 +1,115 @@
+package bloomseq
+
+import (
+	pb "github.com/krl/bloomtree/bloomseq/pb"
+	"github.com/krl/bloomtree/store"
+)
+
+// Stats describe the structure of a sequence. Nodes held in memory
+// are loaded, treeRefs are not. Block sizes are only known for nodes
+// read from the store.
+type Stats struct {
+	// leaves at every depth, the root is at depth 0
+	LeafDepths []int
+
+	// nodes by type: node2, node3 and leaf
+	Nodes map[string]int
+
+	Loaded   int
+	Unloaded int
+
+	Blocks     int
+	BlockBytes int
+}
+
+func (s Stats) Leaves() int {
+	leaves := 0
+	for _, n := range s.LeafDepths {
+		leaves += n
+	}
+	return leaves
+}
+
+func (s Stats) AvgBlockSize() float64 {
+	if s.Blocks == 0 {
+		return 0
+	}
+	return float64(s.BlockBytes) / float64(s.Blocks)
+}
+
+func (s *Stats) addLeaf(depth int) {
+	for len(s.LeafDepths) <= depth {
+		s.LeafDepths = append(s.LeafDepths, 0)
+	}
+	s.LeafDepths[depth]++
+}
+
+func (s *Stats) add(t tree, depth int, stopAtUnloaded bool) error {
+	var children []tree
+
+	switch n := t.(type) {
+	case node2:
+		s.Loaded++
+		s.Nodes["node2"]++
+		children = n.children
+	case node3:
+		s.Loaded++
+		s.Nodes["node3"]++
+		children = n.children
+	case leaf:
+		s.Loaded++
+		s.Nodes["leaf"]++
+		s.addLeaf(depth)
+	case treeRef:
+		s.Unloaded++
+		if stopAtUnloaded {
+			return nil
+		}
+
+		// read the block itself, so that children stay unloaded
+		block, err := n.store.Get(n.key)
+		if err != nil {
+			return err
+		}
+		message, err := decode(block)
+		if err != nil {
+			return err
+		}
+
+		s.Blocks++
+		s.BlockBytes += len(block)
+		s.Nodes[blockTypes[message.GetType()]]++
+
+		if message.GetType() == pb.Tree_Leaf {
+			s.addLeaf(depth)
+		}
+		for _, link := range message.Links {
+			children = append(children, treeRef{key: store.Key(link), store: n.store})
+		}
+	}
+
+	for _, c := range children {
+		err := s.add(c, depth+1, stopAtUnloaded)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Stats walks the sequence and describes its structure. With
+// stopAtUnloaded, no blocks are read, and nothing below a treeRef is
+// counted.
+func (r BloomSeq) Stats(stopAtUnloaded bool) (Stats, error) {
+	stats := Stats{
+		LeafDepths: []int{},
+		Nodes:      map[string]int{},
+	}
+
+	if r.value == nil {
+		return stats, nil
+	}
+
+	err := stats.add(r.value, 0, stopAtUnloaded)
+	return stats, err
+}
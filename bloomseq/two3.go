@@ -2,8 +2,8 @@ package bloomseq
 
 import (
 	proto "code.google.com/p/goprotobuf/proto"
-	mdag "github.com/ipfs/go-ipfs/merkledag"
 	pb "github.com/krl/bloomtree/bloomseq/pb"
+	"github.com/krl/bloomtree/store"
 )
 
 // tree stuff
@@ -13,7 +13,7 @@ type tree interface {
 	getAt(uint64) (tree, leaf)
 	removeAt(uint64) (tree, bool)
 	count() uint64
-	persist(dserv mdag.DAGService) treeRef
+	persist(store.BlockStore) treeRef
 
 	// for tests only
 	getLeavesDepth(int) []int
@@ -98,7 +98,7 @@ func (t node2) removeAt(i uint64) (tree, bool) {
 	} else if underflow {
 
 		// find the appropriate sibling to resolve imbalance
-		switch s := t.children[sibling_index].(type) {
+		switch s := load(t.children[sibling_index]).(type) {
 		case node3:
 
 			new_sibling_children := make([]tree, 2)
@@ -291,7 +291,7 @@ func (t node3) removeAt(i uint64) (tree, bool) {
 			sibling_index = index - 1
 		}
 
-		switch s := t.children[sibling_index].(type) {
+		switch s := load(t.children[sibling_index]).(type) {
 		case node3:
 
 			// let's steal a child!
@@ -481,128 +481,126 @@ func (t leaf) countUnreferencedNodes() int {
 
 // persistance
 
-func refFromTree(t tree, dserv mdag.DAGService) treeRef {
+func refFromTree(t tree, s store.BlockStore) treeRef {
 
 	var datatype pb.Tree_DataType
 
-	node := new(mdag.Node)
 	message := new(pb.Tree)
 
-	switch s := t.(type) {
+	switch n := t.(type) {
 	case node2:
 		datatype = pb.Tree_Node2
-		node.AddRawLink("0", s.children[0].persist(dserv).link)
-		node.AddRawLink("1", s.children[1].persist(dserv).link)
+		for _, c := range n.children {
+			message.Links = append(message.Links, []byte(c.persist(s).key))
+		}
 	case node3:
 		datatype = pb.Tree_Node3
-		node.AddRawLink("0", s.children[0].persist(dserv).link)
-		node.AddRawLink("1", s.children[1].persist(dserv).link)
-		node.AddRawLink("2", s.children[2].persist(dserv).link)
+		for _, c := range n.children {
+			message.Links = append(message.Links, []byte(c.persist(s).key))
+		}
 	case leaf:
 		datatype = pb.Tree_Leaf
-		message.Data = s.Value
+		message.Data = n.Value
 	}
 
 	message.Type = &datatype
 	message.Count = proto.Uint64(t.count())
 
 	marshalled, _ := proto.Marshal(message)
-	node.Data = marshalled
 
-	_, err := dserv.Add(node)
+	key, err := s.Put(marshalled)
 	if err != nil {
 		panic(err)
 	}
 
-	link, err := mdag.MakeLink(node)
-
 	return treeRef{
-		link:  link,
-		dserv: dserv,
+		key:   key,
+		store: s,
 	}
 }
 
-func (t node2) persist(dserv mdag.DAGService) treeRef {
-	return refFromTree(t, dserv)
+func (t node2) persist(s store.BlockStore) treeRef {
+	return refFromTree(t, s)
 }
 
-func (t node3) persist(dserv mdag.DAGService) treeRef {
-	return refFromTree(t, dserv)
+func (t node3) persist(s store.BlockStore) treeRef {
+	return refFromTree(t, s)
 }
 
-func (t leaf) persist(dserv mdag.DAGService) treeRef {
-	return refFromTree(t, dserv)
+func (t leaf) persist(s store.BlockStore) treeRef {
+	return refFromTree(t, s)
 }
 
 // Operations on tree references
 
 type treeRef struct {
-	link  *mdag.Link
-	dserv mdag.DAGService
+	key   store.Key
+	store store.BlockStore
 }
 
 func (r treeRef) read() tree {
-	node, err := r.link.GetNode(r.dserv)
+	block, err := r.store.Get(r.key)
 	if err != nil {
 		panic(err)
 	}
 
 	unmarshalled := new(pb.Tree)
 
-	err = proto.Unmarshal(node.Data, unmarshalled)
+	err = proto.Unmarshal(block, unmarshalled)
 	if err != nil {
 		panic(err)
 	}
 
-	switch *unmarshalled.Type {
-	case pb.Tree_Leaf:
-		return newLeaf(unmarshalled.Data)
-
-	case pb.Tree_Node2:
-		child0, err := node.GetNodeLink("0")
-		if err != nil {
-			panic(err)
-		}
+	links := make([]store.Key, len(unmarshalled.Links))
+	for i, link := range unmarshalled.Links {
+		links[i] = store.Key(link)
+	}
 
-		child1, err := node.GetNodeLink("1")
+	// trees written before blocks held the keys of their children
+	// link to them as merkledag nodes
+	if len(links) == 0 && *unmarshalled.Type != pb.Tree_Leaf {
+		links, err = store.LegacyLinks(r.store, r.key)
 		if err != nil {
 			panic(err)
 		}
+	}
 
-		return newNode2([]tree{
-			treeRef{link: child0, dserv: r.dserv},
-			treeRef{link: child1, dserv: r.dserv},
-		})
+	children := make([]tree, len(links))
+	for i, link := range links {
+		children[i] = treeRef{key: link, store: r.store}
+	}
 
-	case pb.Tree_Node3:
-		child0, err := node.GetNodeLink("0")
-		if err != nil {
-			panic(err)
-		}
+	switch *unmarshalled.Type {
+	case pb.Tree_Leaf:
+		return newLeaf(unmarshalled.Data)
 
-		child1, err := node.GetNodeLink("1")
-		if err != nil {
-			panic(err)
+	case pb.Tree_Node2:
+		if len(children) != 2 {
+			panic("node2 without 2 links")
 		}
+		return newNode2(children)
 
-		child2, err := node.GetNodeLink("2")
-		if err != nil {
-			panic(err)
+	case pb.Tree_Node3:
+		if len(children) != 3 {
+			panic("node3 without 3 links")
 		}
-
-		return newNode3([]tree{
-			treeRef{link: child0, dserv: r.dserv},
-			treeRef{link: child1, dserv: r.dserv},
-			treeRef{link: child2, dserv: r.dserv},
-		})
+		return newNode3(children)
 	}
 	panic("unhandled case")
 	return nil
 }
 
+// load resolves a reference to the node it points to
+func load(t tree) tree {
+	if r, ok := t.(treeRef); ok {
+		return r.read()
+	}
+	return t
+}
+
 // all indirected methods
 
-func (r treeRef) persist(_ mdag.DAGService) treeRef {
+func (r treeRef) persist(_ store.BlockStore) treeRef {
 	// already persisted!
 	return r
 }
@@ -0,0 +1,157 @@
+package bloomseq
+
+import (
+	"fmt"
+	pb "github.com/krl/bloomtree/bloomseq/pb"
+	"github.com/krl/bloomtree/store"
+)
+
+// Violation is a problem with one block of a persisted sequence
+type Violation struct {
+	Key     store.Key
+	Problem string
+}
+
+func (v Violation) String() string {
+	return fmt.Sprintf("%v: %v", v.Key, v.Problem)
+}
+
+// Report lists the problems Verify found in the blocks it checked
+type Report struct {
+	Blocks     int
+	Violations []Violation
+}
+
+func (r Report) OK() bool {
+	return len(r.Violations) == 0
+}
+
+// what a verified subtree looks like to its parent
+type checked struct {
+	valid  bool
+	count  uint64
+	height int
+}
+
+type verifier struct {
+	store  store.BlockStore
+	report Report
+	seen   map[store.Key]checked
+}
+
+func (v *verifier) fail(key store.Key, problem string, args ...interface{}) {
+	v.report.Violations = append(v.report.Violations, Violation{
+		Key:     key,
+		Problem: fmt.Sprintf(problem, args...),
+	})
+}
+
+var linkCounts = map[pb.Tree_DataType]int{
+	pb.Tree_Node2: 2,
+	pb.Tree_Node3: 3,
+	pb.Tree_Leaf:  0,
+}
+
+// check verifies the subtree at key. Blocks shared between subtrees,
+// such as equal leaves, are only checked once.
+func (v *verifier) check(key store.Key) checked {
+	if c, ok := v.seen[key]; ok {
+		return c
+	}
+
+	c := v.checkBlock(key)
+	v.seen[key] = c
+	return c
+}
+
+func (v *verifier) checkBlock(key store.Key) checked {
+	block, err := v.store.Get(key)
+	if err != nil {
+		v.fail(key, "can't read block: %v", err)
+		return checked{}
+	}
+	v.report.Blocks++
+
+	message, err := decode(block)
+	if err != nil || message.Type == nil || message.Count == nil {
+		v.fail(key, "can't decode block")
+		return checked{}
+	}
+
+	links, ok := linkCounts[message.GetType()]
+	if !ok {
+		v.fail(key, "unknown block type %v", message.GetType())
+		return checked{}
+	}
+
+	children := []store.Key{}
+	if links > 0 || len(message.Links) > 0 {
+		children, err = store.TreeLinks(v.store, key, message.Links)
+		if err != nil {
+			v.fail(key, "can't read links: %v", err)
+			return checked{}
+		}
+	}
+
+	// the key of a legacy block hashes links with sizes the block
+	// doesn't hold, the DAG store checks it instead
+	legacy := len(message.Links) == 0 && len(children) > 0
+	if !legacy && store.Hash(block) != key {
+		v.fail(key, "block does not match its key")
+	}
+
+	if len(children) != links {
+		v.fail(key, "%v with %v links", message.GetType(), len(children))
+		return checked{}
+	}
+
+	if message.GetType() == pb.Tree_Leaf {
+		if message.GetCount() != 1 {
+			v.fail(key, "leaf with count %v", message.GetCount())
+		}
+		return checked{valid: true, count: 1, height: 0}
+	}
+
+	// every child is checked, but problems further down are reported
+	// there, and not again here
+	checks := make([]checked, len(children))
+	valid := true
+	for i, child := range children {
+		checks[i] = v.check(child)
+		valid = valid && checks[i].valid
+	}
+	if !valid {
+		return checked{}
+	}
+
+	var count uint64
+	for _, c := range checks {
+		count += c.count
+		if c.height != checks[0].height {
+			v.fail(key, "leaves at different depths below %v", message.GetType())
+		}
+	}
+
+	if count != message.GetCount() {
+		v.fail(key, "count is %v, children hold %v", message.GetCount(), count)
+	}
+
+	return checked{
+		valid:  true,
+		count:  message.GetCount(),
+		height: checks[0].height + 1,
+	}
+}
+
+// Verify checks every block of the sequence persisted with the given
+// root key: that it can be read and decoded, that it matches its key,
+// that counts add up, and that all leaves are at the same depth
+func Verify(s store.BlockStore, root store.Key) Report {
+	v := &verifier{
+		store: s,
+		seen:  map[store.Key]checked{},
+	}
+
+	v.check(root)
+	return v.report
+}
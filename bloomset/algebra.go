@@ -0,0 +1,273 @@
+package bloomset
+
+import (
+	"bytes"
+	"errors"
+	"github.com/krl/bloomtree/filter"
+)
+
+// load resolves a reference to the node it points to
+func load(t tree) tree {
+	if r, ok := t.(treeRef); ok {
+		return r.read()
+	}
+	return t
+}
+
+// contains looks for a leaf with the same bytes, only descending into
+// subtrees whose filters may contain it
+func contains(t tree, l leaf) bool {
+	if !t.getFilter().MayContain(l.filter) {
+		return false
+	}
+
+	switch n := load(t).(type) {
+	case node:
+		return contains(n.children[0], l) || contains(n.children[1], l)
+	case leaf:
+		return bytes.Equal(n.bytes, l.bytes)
+	}
+	return false
+}
+
+// disjoint tells if no leaf of t can be in a tree with the given root
+// filter. A leaf in both has keys in both filters in every field it has
+// keys in, so only the fields every leaf of t has keys in can tell.
+func disjoint(root filter.Filter, t tree) bool {
+	f := t.getFilter()
+
+	filled := filter.Filter{}
+	for _, k := range t.getFilled() {
+		filled[k] = f[k]
+	}
+	return !root.MayIntersect(filled)
+}
+
+// graft adds a whole subtree, following the insertion policy down
+// until it reaches a subtree of comparable size
+func graft(t tree, g tree, policy InsertPolicy) tree {
+	if t == nil {
+		return g
+	}
+
+	if t.count() <= g.count() {
+		return newNode(asChild(t), asChild(g))
+	}
+
+	n := load(t).(node)
+
+	branches := [2]Branch{}
+
+	for i := 0; i < 2; i++ {
+		branches[i] = Branch{
+			Filter: n.children[i].getFilter(),
+			Count:  n.children[i].count(),
+		}
+	}
+
+	if policy.Choose(branches, g.getFilter()) == 0 {
+		return newNode(graft(n.children[0], g, policy), n.children[1])
+	} else {
+		return newNode(n.children[0], graft(n.children[1], g, policy))
+	}
+}
+
+// keep returns the part of t made up of the leaves for which keepLeaf
+// is true. Subtrees for which skip is true are dropped or kept whole
+// without being visited, depending on keepSkipped. The second return
+// value tells if all of t was kept, in which case t itself is
+// returned so that persisted subtrees are reused.
+func keep(t tree, skip func(tree) bool, keepSkipped bool, keepLeaf func(leaf) bool) (tree, bool) {
+	if skip(t) {
+		if keepSkipped {
+			return t, true
+		}
+		return nil, false
+	}
+
+	switch n := load(t).(type) {
+	case node:
+		c0, all0 := keep(n.children[0], skip, keepSkipped, keepLeaf)
+		c1, all1 := keep(n.children[1], skip, keepSkipped, keepLeaf)
+
+		switch {
+		case all0 && all1:
+			return t, true
+		case c0 == nil:
+			return c1, false
+		case c1 == nil:
+			return c0, false
+		}
+		return newNode(c0, c1), false
+	case leaf:
+		if keepLeaf(n) {
+			return t, true
+		}
+	}
+	return nil, false
+}
+
+var ErrIncompatible = errors.New("sets differ in schema or key")
+
+// compatible checks that the values of o can be in s: that both sets
+// have the same schema and key, and filters that merge
+func (s BloomSet) compatible(o BloomSet) error {
+	if !sameSchema(s.schema, o.schema) || !sameKey(s.key, o.key) {
+		return ErrIncompatible
+	}
+	if s.value != nil && o.value != nil {
+		return s.value.getFilter().Matches(o.value.getFilter())
+	}
+	return nil
+}
+
+func sameSchema(s1, s2 filter.Schema) bool {
+	if len(s1) != len(s2) {
+		return false
+	}
+	for i := range s1 {
+		if s1[i] != s2[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func sameKey(k1, k2 *filter.KeyInfo) bool {
+	if k1 == nil || k2 == nil {
+		return k1 == k2
+	}
+	return bytes.Equal(k1.Check, k2.Check)
+}
+
+// Union returns a set with the values of both sets. It panics if the
+// sets are not compatible, TryUnion returns the error instead.
+func (s BloomSet) Union(o BloomSet) BloomSet {
+	set, err := s.TryUnion(o)
+	if err != nil {
+		panic(err)
+	}
+	return set
+}
+
+// TryUnion returns a set with the values of both sets, which need the
+// same schema and key, and filters of the same types and sizes.
+// Subtrees of o that can't have values in common with s are grafted
+// whole.
+func (s BloomSet) TryUnion(o BloomSet) (BloomSet, error) {
+	if err := s.compatible(o); err != nil {
+		return s, err
+	}
+	return s.union(o), nil
+}
+
+func (s BloomSet) union(o BloomSet) BloomSet {
+	if s.value == nil {
+		return s.with(o.value)
+	}
+	if o.value == nil {
+		return s
+	}
+
+	root := s.value.getFilter()
+	result := s.value
+
+	var add func(t tree)
+	add = func(t tree) {
+		if disjoint(root, t) {
+			result = graft(result, t, s.policy)
+			return
+		}
+
+		switch n := load(t).(type) {
+		case node:
+			add(n.children[0])
+			add(n.children[1])
+		case leaf:
+			if !contains(s.value, n) {
+				result = graft(result, n, s.policy)
+			}
+		}
+	}
+	add(o.value)
+
+	return s.with(result)
+}
+
+// Intersect returns a set with the values found in both sets. It
+// panics if the sets are not compatible, TryIntersect returns the
+// error instead.
+func (s BloomSet) Intersect(o BloomSet) BloomSet {
+	set, err := s.TryIntersect(o)
+	if err != nil {
+		panic(err)
+	}
+	return set
+}
+
+// TryIntersect returns a set with the values found in both sets, which
+// are checked as for TryUnion. Subtrees of s that can't have values in
+// common with o are skipped.
+func (s BloomSet) TryIntersect(o BloomSet) (BloomSet, error) {
+	if err := s.compatible(o); err != nil {
+		return s, err
+	}
+	return s.intersect(o), nil
+}
+
+func (s BloomSet) intersect(o BloomSet) BloomSet {
+	if s.value == nil || o.value == nil {
+		return s.with(nil)
+	}
+
+	root := o.value.getFilter()
+
+	result, _ := keep(s.value,
+		func(t tree) bool {
+			return disjoint(root, t)
+		}, false,
+		func(l leaf) bool {
+			return contains(o.value, l)
+		})
+
+	return s.with(result)
+}
+
+// Difference returns a set with the values of s that are not in o. It
+// panics if the sets are not compatible, TryDifference returns the
+// error instead.
+func (s BloomSet) Difference(o BloomSet) BloomSet {
+	set, err := s.TryDifference(o)
+	if err != nil {
+		panic(err)
+	}
+	return set
+}
+
+// TryDifference returns a set with the values of s that are not in o,
+// which are checked as for TryUnion. Subtrees of s that can't have
+// values in common with o are kept whole.
+func (s BloomSet) TryDifference(o BloomSet) (BloomSet, error) {
+	if err := s.compatible(o); err != nil {
+		return s, err
+	}
+	return s.difference(o), nil
+}
+
+func (s BloomSet) difference(o BloomSet) BloomSet {
+	if s.value == nil || o.value == nil {
+		return s
+	}
+
+	root := o.value.getFilter()
+
+	result, _ := keep(s.value,
+		func(t tree) bool {
+			return disjoint(root, t)
+		}, true,
+		func(l leaf) bool {
+			return !contains(o.value, l)
+		})
+
+	return s.with(result)
+}
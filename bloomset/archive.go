@@ -0,0 +1,31 @@
+package bloomset
+
+import (
+	"errors"
+	"github.com/krl/bloomtree/store"
+	"io"
+)
+
+var ErrNotSet = errors.New("archive does not hold a set")
+
+// Export writes every block of a persisted set to w as an archive
+func (s BloomSet) Export(w io.Writer) error {
+	ref, ok := s.value.(treeRef)
+	if !ok {
+		return ErrNotPersisted
+	}
+	return store.Export(w, ref.store, ref.key, store.KindSet)
+}
+
+// Import puts the blocks of an archive into st and returns a set with
+// the settings of s, holding the tree of the archive
+func (s BloomSet) Import(in io.Reader, st store.BlockStore) (BloomSet, error) {
+	header, err := store.Import(in, st)
+	if err != nil {
+		return BloomSet{}, err
+	}
+	if header.Kind != store.KindSet {
+		return BloomSet{}, ErrNotSet
+	}
+	return s.Load(st, header.Root), nil
+}
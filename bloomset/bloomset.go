@@ -1,37 +1,61 @@
 package bloomset
 
 import (
-	mdag "github.com/ipfs/go-ipfs/merkledag"
 	"github.com/krl/bloomtree/filter"
+	"github.com/krl/bloomtree/store"
 	. "github.com/krl/bloomtree/value"
 )
 
 type BloomSet struct {
 	value   tree
 	valfunc func([]byte) Value
+	policy  InsertPolicy
+	schema  filter.Schema
+	key     *filter.KeyInfo
 }
 
-func NewBloomSet(valfunc func([]byte) Value) BloomSet {
-	return BloomSet{valfunc: valfunc}
+// NewBloomSet creates an empty set, the policy decides where new
+// values are inserted. A nil policy means DistancePolicy.
+func NewBloomSet(valfunc func([]byte) Value, policy InsertPolicy) BloomSet {
+	if policy == nil {
+		policy = DistancePolicy{}
+	}
+	return BloomSet{valfunc: valfunc, policy: policy}
+}
+
+// returns a set with the same settings holding another tree
+func (s BloomSet) with(value tree) BloomSet {
+	return BloomSet{
+		value:   value,
+		valfunc: s.valfunc,
+		policy:  s.policy,
+		schema:  s.schema,
+		key:     s.key,
+	}
 }
 
+// Insert adds a value to the set. It panics if the value doesn't
+// match the schema of the set, or the filters of the values in it,
+// TryInsert returns the error instead.
 func (s BloomSet) Insert(v Value) BloomSet {
+	set, err := s.TryInsert(v)
+	if err != nil {
+		panic(err)
+	}
+	return set
+}
+
+func (s BloomSet) insert(v Value) BloomSet {
 	lf := leaf{
 		bytes:  v.Serialize(),
 		filter: v.GetFilter(),
 	}
 
 	if s.value == nil {
-		return BloomSet{
-			value:   lf,
-			valfunc: s.valfunc,
-		}
+		return s.with(lf)
 	}
 
-	return BloomSet{
-		value:   s.value.insert(lf),
-		valfunc: s.valfunc,
-	}
+	return s.with(s.value.insert(lf, s.policy))
 }
 
 func (s BloomSet) Remove(v Value) BloomSet {
@@ -41,13 +65,10 @@ func (s BloomSet) Remove(v Value) BloomSet {
 	}
 
 	if s.value == nil {
-		return BloomSet{}
+		return s
 	}
 	value, _ := s.value.remove(leaf)
-	return BloomSet{
-		value:   value,
-		valfunc: s.valfunc,
-	}
+	return s.with(value)
 }
 
 // we pass a pointer here, so that the tree is mutated as
@@ -65,7 +86,7 @@ func (s *BloomSet) Find(f filter.Filter) <-chan Value {
 	}()
 
 	go func() {
-		if s.value.getFilter().MayContain(f) {
+		if s.value != nil && mayContain(s.value.getParts(), f) {
 			s.value = s.value.find(f, bytechan)
 		}
 		close(bytechan)
@@ -74,6 +95,10 @@ func (s *BloomSet) Find(f filter.Filter) <-chan Value {
 	return valuechan
 }
 
+// GetLeavesDepth returns the depth of every leaf, loading the whole
+// set.
+//
+// Deprecated: use Stats.
 func (s BloomSet) GetLeavesDepth() []int {
 	if s.value == nil {
 		return []int{}
@@ -81,17 +106,42 @@ func (s BloomSet) GetLeavesDepth() []int {
 	return s.value.getLeavesDepth(0)
 }
 
-func (s BloomSet) Persist(dserv mdag.DAGService) BloomSet {
+// Persist writes the set to the store, along with its schema and key
+// info
+func (s BloomSet) Persist(st store.BlockStore) BloomSet {
 	if s.value != nil {
-		return BloomSet{
-			value:   s.value.persist(dserv),
-			valfunc: s.valfunc,
-		}
+		return s.with(persistRoot(s.value, st, s.schema, s.key))
 	} else {
-		return BloomSet{}
+		return s.with(nil)
+	}
+}
+
+// Load returns a set with the settings of s, holding the tree
+// persisted with the given root key. A schema or key info persisted
+// with the tree replaces that of s.
+func (s BloomSet) Load(st store.BlockStore, root store.Key) BloomSet {
+	loaded := s.with(newRef(root, st))
+
+	schema, key := readRoot(st, root)
+	if schema != nil {
+		loaded.schema = schema
+	}
+	if key != nil {
+		loaded.key = key
+	}
+	return loaded
+}
+
+// Root returns the key of a persisted set, or an empty key if the set
+// is empty or has changes that are not persisted
+func (s BloomSet) Root() store.Key {
+	if ref, ok := s.value.(treeRef); ok {
+		return ref.key
 	}
+	return ""
 }
 
+// Deprecated: use Stats.
 func (r BloomSet) CountUnreferencedNodes() int {
 	if r.value != nil {
 		return r.value.countUnreferencedNodes()
@@ -1,15 +1,25 @@
 package bloomset
 
 import (
+	"bytes"
+	proto "code.google.com/p/goprotobuf/proto"
+	"encoding/json"
 	"fmt"
+	mdag "github.com/ipfs/go-ipfs/merkledag"
+	pb "github.com/krl/bloomtree/bloomset/pb"
 	"github.com/krl/bloomtree/filter"
+	"github.com/krl/bloomtree/store"
+	"github.com/krl/bloomtree/value"
+	"math"
+	"math/rand"
+	"strings"
 	"testing"
 
 	. "github.com/krl/bloomtree/common"
 )
 
 func TestSingletonTree(t *testing.T) {
-	set := NewBloomSet(DeserializeTextValue)
+	set := NewBloomSet(DeserializeTextValue, nil)
 
 	val1 := NewTextValue("wonk")
 	val2 := NewTextValue("donk")
@@ -31,7 +41,7 @@ func TestSingletonTree(t *testing.T) {
 
 func TestQueries(t *testing.T) {
 
-	set := NewBloomSet(DeserializeTextValue)
+	set := NewBloomSet(DeserializeTextValue, nil)
 
 	set = set.Insert(NewTextValue("one"))
 	set = set.Insert(NewTextValue("one two"))
@@ -108,36 +118,110 @@ func TestQueries(t *testing.T) {
 
 }
 
+// skew is the tolerated difference between the deepest and the most
+// shallow leaf, relative to the most shallow one
+var policies = []struct {
+	name   string
+	policy InsertPolicy
+	skew   float64
+}{
+	{"distance", DistancePolicy{}, 0.5},
+	{"balance", BalancePolicy{}, 0.5},
+	{"weighted", WeightedPolicy{Weights: filter.Weights{"count": 4}}, 0.5},
+	{"random", RandomPolicy{Rand: rand.New(rand.NewSource(1))}, 0.5},
+	// clusters at the expense of balance
+	{"growth", GrowthPolicy{}, 2},
+}
+
 func TestReasonableBalance(t *testing.T) {
-	set := NewBloomSet(DeserializeTextValue)
+	for _, p := range policies {
+		set := NewBloomSet(DeserializeTextValue, p.policy)
 
-	for i := 0; i < 1000; i++ {
-		set = set.Insert(NewTextValue(fmt.Sprintf("element #%v", i)))
-	}
+		for i := 0; i < 1000; i++ {
+			set = set.Insert(NewTextValue(fmt.Sprintf("element #%v", i)))
+		}
 
-	depths := set.GetLeavesDepth()
+		depths := set.GetLeavesDepth()
 
-	max := 0
-	min := 10000
+		max := 0
+		min := 10000
 
-	for _, v := range depths {
-		if v > max {
-			max = v
+		for _, v := range depths {
+			if v > max {
+				max = v
+			}
+			if v < min {
+				min = v
+			}
 		}
-		if v < min {
-			min = v
+
+		// semi-arbitrary definition of balance
+		if float64(max-min) > float64(min)*p.skew {
+			t.Fatalf("Tree is not very well balanced with %v policy!", p.name)
 		}
 	}
+}
+
+func TestWeightedPolicy(t *testing.T) {
+	leaf := NewTextValue("a b c d e f g h").GetFilter()
+
+	// same words, but a different word count
+	similar := NewTextValue("a b c d e f g h i").GetFilter()
+
+	// same word count, but different words
+	counted := NewTextValue("s t u v w x y z").GetFilter()
+
+	children := [2]Branch{
+		{Filter: similar, Count: 1},
+		{Filter: counted, Count: 1},
+	}
+
+	if (WeightedPolicy{}).Choose(children, leaf) != 0 {
+		t.Fatal("Unweighted distance should favour the shared words")
+	}
+
+	weights := filter.Weights{"words": 1, "count": 100}
+
+	if (WeightedPolicy{Weights: weights}).Choose(children, leaf) != 1 {
+		t.Fatal("Weighted distance should favour the shared word count")
+	}
+}
+
+func TestQueryCost(t *testing.T) {
+	for _, p := range policies {
+		bstore := store.NewMemoryStore()
+
+		set := NewBloomSet(DeserializeTextValue, p.policy)
+
+		count := 1000
+
+		for i := 0; i < count; i++ {
+			set = set.Insert(NewTextValue(fmt.Sprintf("haystrand #%v", i)))
+		}
 
-	// semi-arbitrary definition of balance
-	if (max - min) > min/2 {
-		t.Fatalf("Tree is not very well balanced!")
+		set = set.Insert(NewTextValue("needle"))
+		set = set.Persist(bstore)
+
+		found := 0
+		for _ = range set.Find(TextFilter("needle")) {
+			found++
+		}
+
+		if found == 0 {
+			t.Fatalf("did not find the needle with %v policy!", p.name)
+		}
+
+		// nodes pulled into memory by the query
+		loaded := set.CountUnreferencedNodes()
+		if loaded > count/20 {
+			t.Fatalf("Query loaded %v nodes with %v policy", loaded, p.name)
+		}
 	}
 }
 
 func TestEmptyFilter(t *testing.T) {
 
-	set := NewBloomSet(DeserializeTextValue)
+	set := NewBloomSet(DeserializeTextValue, nil)
 
 	for i := 0; i < 10; i++ {
 		set = set.Insert(NewTextValue(fmt.Sprintf("entry #%v", i)))
@@ -158,7 +242,7 @@ func TestEmptyFilter(t *testing.T) {
 
 func TestHaystack(t *testing.T) {
 
-	set := NewBloomSet(DeserializeTextValue)
+	set := NewBloomSet(DeserializeTextValue, nil)
 
 	for i := 0; i < 1000; i++ {
 		set = set.Insert(NewTextValue(fmt.Sprintf("haystrand #%v", i)))
@@ -176,7 +260,7 @@ func TestHaystack(t *testing.T) {
 
 func TestHaystackRemoving(t *testing.T) {
 
-	set := NewBloomSet(DeserializeTextValue)
+	set := NewBloomSet(DeserializeTextValue, nil)
 
 	count := 1000
 
@@ -203,14 +287,14 @@ func TestHaystackRemoving(t *testing.T) {
 // persistance test
 
 func TestPersistSingletonRoot(t *testing.T) {
-	dserv := GetMockDagServ(t)
+	bstore := store.NewMemoryStore()
 
-	set := NewBloomSet(DeserializeTextValue)
+	set := NewBloomSet(DeserializeTextValue, nil)
 
 	val := NewTextValue("wonk")
 	set = set.Insert(val)
 
-	persisted := set.Persist(dserv)
+	persisted := set.Persist(bstore)
 
 	result := persisted.Find(filter.EmptyFilter())
 
@@ -221,9 +305,9 @@ func TestPersistSingletonRoot(t *testing.T) {
 
 func TestPersistHaystack(t *testing.T) {
 
-	dserv := GetMockDagServ(t)
+	bstore := store.NewDAGStore(GetMockDagServ(t))
 
-	set := NewBloomSet(DeserializeTextValue)
+	set := NewBloomSet(DeserializeTextValue, nil)
 
 	count := 1000
 
@@ -233,7 +317,7 @@ func TestPersistHaystack(t *testing.T) {
 
 	set = set.Insert(NewTextValue("needle"))
 
-	persisted := set.Persist(dserv)
+	persisted := set.Persist(bstore)
 
 	if persisted.CountUnreferencedNodes() != 1 {
 		t.Fatal("dereference fail")
@@ -253,3 +337,1412 @@ func TestPersistHaystack(t *testing.T) {
 		t.Fatalf("should have dereferenced log(n) nodes (got %v)", unreffed)
 	}
 }
+
+func TestReadOnce(t *testing.T) {
+	bstore := &countingStore{
+		BlockStore: store.NewMemoryStore(),
+		keys:       map[store.Key]int{},
+	}
+
+	set := NewBloomSet(DeserializeTextValue, nil)
+	for i := 0; i < 200; i++ {
+		set = set.Insert(NewTextValue(fmt.Sprintf("haystrand #%v", i)))
+	}
+	root := set.Persist(bstore).Root()
+
+	loaded := NewBloomSet(DeserializeTextValue, nil).Load(bstore, root)
+	delete(bstore.keys, root) // read once more for the schema
+
+	found := 0
+	for _ = range loaded.Find(TextFilter("haystrand")) {
+		found++
+	}
+	if found != 200 {
+		t.Fatalf("Should have found 200 values, got %v", found)
+	}
+
+	loaded = loaded.Remove(NewTextValue("haystrand #10"))
+	if loaded.value.count() != 199 {
+		t.Fatalf("Should have 199 values, got %v", loaded.value.count())
+	}
+
+	for key, reads := range bstore.keys {
+		if reads > 1 {
+			t.Fatalf("Block %v read %v times", key, reads)
+		}
+	}
+}
+
+func TestCacheBound(t *testing.T) {
+	bstore := store.NewMemoryStore()
+
+	set := NewBloomSet(DeserializeTextValue, nil)
+	for i := 0; i < 200; i++ {
+		set = set.Insert(NewTextValue(fmt.Sprintf("haystrand #%v", i)))
+	}
+	root := set.Persist(bstore).Root()
+
+	ref := treeRef{key: root, store: bstore, cache: newCache(16)}
+	loaded := set.with(ref)
+
+	if countValues(loaded) != 200 {
+		t.Fatal("Should find every value through a small cache")
+	}
+	if n := ref.cache.order.Len(); n > 16 {
+		t.Fatalf("Should keep at most 16 nodes, kept %v", n)
+	}
+	if _, ok := ref.cache.get(root); ok {
+		t.Fatal("Should have dropped the nodes read first")
+	}
+}
+
+// putLegacy writes a block as a merkledag node linking to its
+// children, as trees were written before blocks held their links
+func putLegacy(t *testing.T, dserv mdag.DAGService, message *pb.Tree, children ...*mdag.Link) *mdag.Link {
+	data, _ := proto.Marshal(message)
+
+	node := &mdag.Node{Data: data}
+	for i, c := range children {
+		node.AddRawLink(fmt.Sprint(i), c)
+	}
+
+	_, err := dserv.Add(node)
+	if err != nil {
+		t.Fatal(err)
+	}
+	link, err := mdag.MakeLink(node)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return link
+}
+
+// legacySet writes a set of two values as a legacy tree
+func legacySet(t *testing.T) (store.BlockStore, store.Key) {
+	dserv := GetMockDagServ(t)
+
+	leafType, nodeType := pb.Tree_Leaf, pb.Tree_Node
+	leaves := []*mdag.Link{}
+	for _, content := range []string{"wonk", "donk"} {
+		v := NewTextValue(content)
+		leaves = append(leaves, putLegacy(t, dserv, &pb.Tree{
+			Type:   &leafType,
+			Data:   v.Serialize(),
+			Filter: filterToMessage(v.GetFilter()),
+		}))
+	}
+
+	root := putLegacy(t, dserv, &pb.Tree{
+		Type:   &nodeType,
+		Filter: filterToMessage(NewTextValue("wonk").GetFilter().Merge(NewTextValue("donk").GetFilter())),
+	}, leaves...)
+
+	return store.NewDAGStore(dserv), store.Key(root.Hash)
+}
+
+func TestLegacyVerify(t *testing.T) {
+	bstore, root := legacySet(t)
+
+	if countValues(NewBloomSet(DeserializeTextValue, nil).Load(bstore, root)) != 2 {
+		t.Fatal("Should read both values of a legacy set")
+	}
+	if report := Verify(bstore, root); !report.OK() || report.Blocks != 3 {
+		t.Fatalf("Should verify a legacy set, got %v", report)
+	}
+
+	stats, err := NewBloomSet(DeserializeTextValue, nil).Load(bstore, root).Stats(false)
+	if err != nil || stats.Leaves() != 2 || stats.Blocks != 3 {
+		t.Fatalf("Should read the stats of a legacy set, got %v", stats)
+	}
+}
+
+func TestLegacyCount(t *testing.T) {
+	bstore := &countingStore{BlockStore: store.NewMemoryStore()}
+
+	put := func(message *pb.Tree) []byte {
+		marshalled, _ := proto.Marshal(message)
+		key, err := bstore.Put(marshalled)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return []byte(key)
+	}
+
+	leafType, nodeType := pb.Tree_Leaf, pb.Tree_Node
+	links := [][]byte{}
+	for _, content := range []string{"a", "b"} {
+		v := NewTextValue(content)
+		links = append(links, put(&pb.Tree{
+			Type:   &leafType,
+			Data:   v.Serialize(),
+			Filter: filterToMessage(v.GetFilter()),
+		}))
+	}
+
+	// written before counts were stored
+	root := put(&pb.Tree{
+		Type:   &nodeType,
+		Links:  links,
+		Filter: filterToMessage(NewTextValue("a").GetFilter()),
+	})
+
+	ref := newRef(store.Key(root), bstore)
+	ref.read()
+	if bstore.gets != 1 {
+		t.Fatalf("Reading a legacy node should not read its children, read %v blocks", bstore.gets)
+	}
+
+	if ref.count() != 2 || ref.count() != 2 {
+		t.Fatal("Should have counted 2 values")
+	}
+	if bstore.gets != 3 {
+		t.Fatalf("Should have read every block once, read %v", bstore.gets)
+	}
+}
+
+func TestRepack(t *testing.T) {
+	bstore := store.NewMemoryStore()
+
+	set := NewBloomSet(DeserializeTextValue, nil)
+
+	count := 1000
+
+	for i := 0; i < count; i++ {
+		set = set.Insert(NewTextValue(fmt.Sprintf("haystrand #%v", i)))
+	}
+
+	set = set.Insert(NewTextValue("needle"))
+	set = set.Persist(bstore)
+
+	repacked, report := set.Repack(bstore)
+
+	// 1001 leaves fit in a tree of depth 10
+	if report.After.Depth != 10 {
+		t.Fatalf("Should have depth 10 after repacking, got %v", report.After.Depth)
+	}
+
+	if report.Before.Blocks != report.After.Blocks {
+		t.Fatalf("Binary trees should have the same number of blocks (%v != %v)",
+			report.Before.Blocks, report.After.Blocks)
+	}
+
+	result := repacked.Find(TextFilter("needle"))
+
+	Content := (<-result).(TextValue).Content
+
+	if Content != "needle" {
+		t.Fatal("did not find the needle!")
+	}
+
+	result = repacked.Find(filter.EmptyFilter())
+
+	found := 0
+	for _ = range result {
+		found++
+	}
+
+	if found != count+1 {
+		t.Fatalf("Should have found %v values, got %v", count+1, found)
+	}
+}
+
+func countValues(set BloomSet) int {
+	count := 0
+	for _ = range set.Find(filter.EmptyFilter()) {
+		count++
+	}
+	return count
+}
+
+func TestSetAlgebra(t *testing.T) {
+	bstore := store.NewMemoryStore()
+
+	a := NewBloomSet(DeserializeTextValue, nil)
+	b := NewBloomSet(DeserializeTextValue, nil)
+
+	for i := 0; i < 100; i++ {
+		a = a.Insert(NewTextValue(fmt.Sprintf("left #%v", i)))
+		b = b.Insert(NewTextValue(fmt.Sprintf("right #%v", i)))
+	}
+
+	for i := 0; i < 20; i++ {
+		a = a.Insert(NewTextValue(fmt.Sprintf("shared #%v", i)))
+		b = b.Insert(NewTextValue(fmt.Sprintf("shared #%v", i)))
+	}
+
+	a = a.Persist(bstore)
+	b = b.Persist(bstore)
+
+	union := a.Union(b)
+
+	if count := countValues(union); count != 220 {
+		t.Fatalf("Union should have 220 values, got %v", count)
+	}
+
+	intersection := a.Intersect(b)
+
+	if count := countValues(intersection); count != 20 {
+		t.Fatalf("Intersection should have 20 values, got %v", count)
+	}
+
+	result := intersection.Find(TextFilter("left"))
+	if <-result != nil {
+		t.Fatal("Intersection should not contain values from one side only")
+	}
+
+	difference := a.Difference(b)
+
+	if count := countValues(difference); count != 100 {
+		t.Fatalf("Difference should have 100 values, got %v", count)
+	}
+
+	result = difference.Find(TextFilter("shared"))
+	if <-result != nil {
+		t.Fatal("Difference should not contain shared values")
+	}
+
+	if count := countValues(a.Difference(a)); count != 0 {
+		t.Fatalf("Difference with itself should be empty, got %v", count)
+	}
+	// the empty value is in both sets, though its field shares no key
+	// with either
+	words := filter.Schema{{Name: "words", Bits: 256, Hashes: 3}}
+	c := NewBloomSet(DeserializeTextValue, nil)
+	d := NewBloomSet(DeserializeTextValue, nil)
+	for _, word := range []string{"", "x"} {
+		c = c.Insert(schemaValue{word, words, nil})
+	}
+	for _, word := range []string{"", "y"} {
+		d = d.Insert(schemaValue{word, words, nil})
+	}
+	c, d = c.Persist(bstore), d.Persist(bstore)
+
+	if count := countValues(c.Intersect(d)); count != 1 {
+		t.Fatalf("Intersection should have the empty value, got %v values", count)
+	}
+	if count := countValues(c.Union(d)); count != 3 {
+		t.Fatalf("Union should have 3 values, got %v", count)
+	}
+	if count := countValues(c.Difference(d)); count != 1 {
+		t.Fatalf("Difference should have 1 value, got %v", count)
+	}
+	// sets whose filters can't merge, or that are keyed differently
+	sized := NewBloomSet(DeserializeTextValue, nil).Insert(schemaValue{"wonk", legacySchema(512), nil})
+	if _, err := a.TryUnion(sized); err == nil {
+		t.Fatal("Should refuse the union of sets with other filter sizes")
+	}
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("Should panic on the union of sets with other filter sizes")
+			}
+		}()
+		a.Union(sized)
+	}()
+
+	k, _ := filter.NewKey([]byte("secret"), "")
+	keyed, _ := NewBloomSet(DeserializeTextValue, nil).WithKey(k)
+	for _, try := range []func(BloomSet) (BloomSet, error){a.TryUnion, a.TryIntersect, a.TryDifference} {
+		if _, err := try(keyed); err != ErrIncompatible {
+			t.Fatalf("Should refuse sets with another key, got %v", err)
+		}
+	}
+}
+
+func TestDiff(t *testing.T) {
+	bstore := store.NewMemoryStore()
+
+	old := NewBloomSet(DeserializeTextValue, nil)
+
+	for i := 0; i < 200; i++ {
+		old = old.Insert(NewTextValue(fmt.Sprintf("haystrand #%v", i)))
+	}
+
+	old = old.Persist(bstore)
+
+	new := old.Insert(NewTextValue("needle"))
+	new = new.Remove(NewTextValue("haystrand #100"))
+	new = new.Persist(bstore)
+
+	added, removed := Diff(old, new)
+
+	if len(added) != 1 || added[0].(TextValue).Content != "needle" {
+		t.Fatalf("Should have added the needle, got %v", added)
+	}
+
+	if len(removed) != 1 || removed[0].(TextValue).Content != "haystrand #100" {
+		t.Fatalf("Should have removed haystrand #100, got %v", removed)
+	}
+
+	added, removed = Diff(new, new)
+
+	if len(added) != 0 || len(removed) != 0 {
+		t.Fatal("Should not find differences between equal versions")
+	}
+}
+
+func TestReachable(t *testing.T) {
+	bstore := store.NewMemoryStore()
+
+	set := NewBloomSet(DeserializeTextValue, nil)
+
+	for i := 0; i < 100; i++ {
+		set = set.Insert(NewTextValue(fmt.Sprintf("haystrand #%v", i)))
+	}
+
+	set = set.Persist(bstore)
+
+	keys, errs := store.Reachable(bstore, set.Root())
+
+	count := 0
+	for _ = range keys {
+		count++
+	}
+
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+
+	// 100 leaves and 99 nodes
+	if count != 199 {
+		t.Fatalf("Should reach 199 blocks, reached %v", count)
+	}
+}
+
+func TestFindWithProof(t *testing.T) {
+	bstore := store.NewMemoryStore()
+
+	set := NewBloomSet(DeserializeTextValue, nil)
+
+	for i := 0; i < 1000; i++ {
+		set = set.Insert(NewTextValue(fmt.Sprintf("haystrand #%v", i)))
+	}
+
+	set = set.Insert(NewTextValue("needle"))
+
+	if _, _, err := set.FindWithProof(TextFilter("needle")); err != ErrNotPersisted {
+		t.Fatal("Should not prove queries on a set that is not persisted")
+	}
+
+	set = set.Persist(bstore)
+
+	values, proof, err := set.FindWithProof(TextFilter("needle"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	verified, err := VerifyFind(set.Root(), TextFilter("needle"), proof)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(verified) != len(values) {
+		t.Fatalf("Verified %v values, found %v", len(verified), len(values))
+	}
+
+	found := false
+	for _, v := range verified {
+		if string(v) == "needle" {
+			found = true
+		}
+	}
+
+	if !found {
+		t.Fatal("did not find the needle!")
+	}
+
+	if len(proof.Blocks) > 100 {
+		t.Fatalf("Proof should not need most of the tree, has %v blocks", len(proof.Blocks))
+	}
+
+	// leaving out a block makes the proof incomplete
+	proof.Blocks = proof.Blocks[:len(proof.Blocks)-1]
+
+	if _, err := VerifyFind(set.Root(), TextFilter("needle"), proof); err == nil {
+		t.Fatal("Incomplete proof should not verify")
+	}
+
+	// a block giving a field twice is rejected, not a panic
+	leafType := pb.Tree_Leaf
+	element := filterToMessage(TextFilter("needle"))[0]
+	block, _ := proto.Marshal(&pb.Tree{
+		Type:   &leafType,
+		Data:   []byte("needle"),
+		Filter: []*pb.FilterElement{element, element},
+	})
+
+	proof = FindProof{Blocks: [][]byte{block}}
+	if _, err := VerifyFind(store.Hash(block), TextFilter("needle"), proof); err != ErrDuplicateField {
+		t.Fatalf("Should reject a duplicate field, got %v", err)
+	}
+}
+
+func TestExportImport(t *testing.T) {
+	src := store.NewMemoryStore()
+
+	set := NewBloomSet(DeserializeTextValue, nil)
+
+	for i := 0; i < 100; i++ {
+		set = set.Insert(NewTextValue(fmt.Sprintf("haystrand #%v", i)))
+	}
+
+	set = set.Insert(NewTextValue("needle")).Persist(src)
+
+	var archive bytes.Buffer
+
+	err := set.Export(&archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dst := store.NewMemoryStore()
+
+	imported, err := NewBloomSet(DeserializeTextValue, nil).Import(&archive, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if countValues(imported) != 101 {
+		t.Fatal("Should import every value")
+	}
+
+	found := 0
+	for _ = range imported.Find(TextFilter("needle")) {
+		found++
+	}
+
+	if found != 1 {
+		t.Fatal("Should find the needle in the imported set")
+	}
+
+	keys, _ := src.Keys()
+	imports, _ := dst.Keys()
+
+	if len(keys) != len(imports) {
+		t.Fatal("Should import exactly the blocks of the set")
+	}
+
+	var seq bytes.Buffer
+	store.Export(&seq, src, set.Root(), store.KindSeq)
+
+	_, err = set.Import(&seq, store.NewMemoryStore())
+	if err != ErrNotSet {
+		t.Fatal("Should not import a sequence as a set")
+	}
+}
+
+func TestVerify(t *testing.T) {
+	bstore := store.NewMemoryStore()
+
+	set := NewBloomSet(DeserializeTextValue, nil)
+
+	for i := 0; i < 100; i++ {
+		set = set.Insert(NewTextValue(fmt.Sprintf("haystrand #%v", i)))
+	}
+
+	set = set.Persist(bstore)
+
+	report := Verify(bstore, set.Root())
+	if !report.OK() || report.Blocks != 199 {
+		t.Fatalf("Should verify a persisted set, got %v", report.Violations)
+	}
+
+	wonk := NewBloomSet(DeserializeTextValue, nil).Insert(NewTextValue("wonk")).Persist(bstore)
+	donk := NewBloomSet(DeserializeTextValue, nil).Insert(NewTextValue("donk")).Persist(bstore)
+
+	// a node with the filter of only one of its children
+	message := &pb.Tree{
+		Type:  pb.Tree_Node.Enum(),
+		Count: proto.Uint64(2),
+		Links: [][]byte{[]byte(wonk.Root()), []byte(donk.Root())},
+	}
+	for name, f := range NewTextValue("wonk").GetFilter() {
+		message.Filter = append(message.Filter, &pb.FilterElement{
+			Name:        proto.String(name),
+			BloomFilter: f.Bytes(),
+		})
+	}
+
+	block, _ := proto.Marshal(message)
+	root, _ := bstore.Put(block)
+
+	report = Verify(bstore, root)
+	if len(report.Violations) != 1 || report.Violations[0].Key != root {
+		t.Fatalf("Should report the node not covering its child, got %v", report.Violations)
+	}
+
+	// both children are checked
+	message.Links = [][]byte{
+		[]byte(store.Hash([]byte("missing"))),
+		[]byte(store.Hash([]byte("also missing"))),
+	}
+	block, _ = proto.Marshal(message)
+	root, _ = bstore.Put(block)
+
+	report = Verify(bstore, root)
+	if len(report.Violations) != 2 {
+		t.Fatalf("Should report both missing blocks, got %v", report.Violations)
+	}
+}
+
+type dumped struct {
+	Type     string
+	Count    uint64
+	Fill     map[string]float64
+	Children []dumped
+}
+
+func TestDump(t *testing.T) {
+	bstore := store.NewMemoryStore()
+
+	set := NewBloomSet(DeserializeTextValue, nil)
+
+	for i := 0; i < 100; i++ {
+		set = set.Insert(NewTextValue(fmt.Sprintf("haystrand #%v", i)))
+	}
+
+	set = set.Persist(bstore)
+
+	var out bytes.Buffer
+
+	err := set.DumpJSON(&out, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var root dumped
+	json.Unmarshal(out.Bytes(), &root)
+
+	if root.Type != "node" || root.Count != 100 {
+		t.Fatalf("Should dump the root node, got %v", root)
+	}
+
+	if root.Fill["words"] <= root.Children[0].Fill["words"] {
+		t.Fatal("Should have a fuller filter at the root than below")
+	}
+
+	for _, c := range root.Children {
+		for _, g := range c.Children {
+			if g.Type != "treeRef" {
+				t.Fatal("Should not load nodes past the depth limit")
+			}
+		}
+	}
+
+	out.Reset()
+	set.DumpDOT(&out, -1)
+
+	nodes := strings.Count(out.String(), "[label=")
+	edges := strings.Count(out.String(), "->")
+
+	if nodes != 199 || edges != 198 {
+		t.Fatalf("Should dump 199 nodes, got %v nodes and %v edges", nodes, edges)
+	}
+	// once read by a find, nodes past the depth limit are loaded
+	countValues(set)
+	out.Reset()
+	set.DumpJSON(&out, 0)
+
+	root = dumped{}
+	json.Unmarshal(out.Bytes(), &root)
+	if root.Type != "node" || len(root.Children) != 0 {
+		t.Fatalf("Should dump a cached root as a node, got %v", root)
+	}
+
+	bstore2, legacy := legacySet(t)
+	out.Reset()
+	NewBloomSet(DeserializeTextValue, nil).Load(bstore2, legacy).DumpJSON(&out, -1)
+
+	root = dumped{}
+	json.Unmarshal(out.Bytes(), &root)
+	if root.Type != "node" || len(root.Children) != 2 {
+		t.Fatalf("Should dump the children of a legacy set, got %v", root)
+	}
+}
+
+func TestStats(t *testing.T) {
+	bstore := store.NewMemoryStore()
+
+	set := NewBloomSet(DeserializeTextValue, nil)
+
+	for i := 0; i < 100; i++ {
+		set = set.Insert(NewTextValue(fmt.Sprintf("haystrand #%v", i)))
+	}
+
+	set = set.Persist(bstore)
+
+	shallow, _ := set.Stats(true)
+
+	if shallow.Unloaded != 1 || shallow.Loaded != 0 || shallow.Blocks != 0 {
+		t.Fatalf("Should stop at the persisted root, got %v", shallow)
+	}
+
+	stats, err := set.Stats(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stats.Leaves() != 100 || stats.Nodes["node"] != 99 || stats.Blocks != 199 {
+		t.Fatalf("Should read the whole set, got %v", stats)
+	}
+
+	depths := set.GetLeavesDepth()
+	deepest := 0
+	for _, d := range depths {
+		if d > deepest {
+			deepest = d
+		}
+	}
+
+	if len(stats.LeafDepths) != deepest+1 || len(stats.Saturation) != deepest+1 {
+		t.Fatal("Should describe every level")
+	}
+
+	if stats.Saturation[0]["words"] < stats.Saturation[deepest]["words"] {
+		t.Fatal("Should have fuller filters near the root")
+	}
+	// nodes read by a find are in the cache, so loaded
+	countValues(set)
+	cached, _ := set.Stats(true)
+	if cached.Unloaded != 0 || cached.Loaded != 199 || cached.Leaves() != 100 {
+		t.Fatalf("Should count cached nodes as loaded, got %v", cached)
+	}
+
+	// a field only some nodes have is averaged over those
+	full := filter.BloomFromBytes(bytes.Repeat([]byte{0xff}, 32), 3, filter.Murmur3)
+	fields := Stats{}
+	fields.addFilter(filter.Filter{"a": full}, 0)
+	fields.addFilter(filter.Filter{"a": full, "b": full}, 0)
+	if fields.Saturation[0]["b"] != 1 {
+		t.Fatalf("Should average b over the nodes with it, got %v", fields.Saturation[0]["b"])
+	}
+}
+
+// a value with a words filter of any size
+// a schema of one legacy field, as filter.NewFilter makes
+func legacySchema(bytes int) filter.Schema {
+	return filter.Schema{{Name: "words", Bits: bytes * 8, Hashes: 3}}
+}
+
+func TestSchema(t *testing.T) {
+	bad := filter.Schema{{Name: "words", Bits: 12, Hashes: 3}}
+	if bad.Check() == nil {
+		t.Fatal("Should refuse fields that aren't whole bytes")
+	}
+
+	words := filter.Schema{{Name: "words", Bits: 256, Hashes: 3}}
+
+	set, err := NewBloomSet(DeserializeTextValue, nil).WithSchema(words)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	set, err = set.TryInsert(schemaValue{"wonk", legacySchema(32), nil})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = set.TryInsert(schemaValue{"donk", legacySchema(16), nil})
+	if _, ok := err.(filter.SchemaError); !ok {
+		t.Fatal("Should refuse values with the wrong filter size")
+	}
+
+	// text values also have a count field
+	_, err = set.TryInsert(NewTextValue("donk"))
+	if err == nil {
+		t.Fatal("Should refuse values with fields not in the schema")
+	}
+
+	_, err = set.TryFind(CountFilter(1))
+	if err == nil {
+		t.Fatal("Should refuse queries on fields not in the schema")
+	}
+
+	// without a schema, a query on a missing field finds nothing
+	found := 0
+	plain := NewBloomSet(DeserializeTextValue, nil).Insert(schemaValue{"wonk", legacySchema(32), nil})
+	for _ = range plain.Find(CountFilter(1)) {
+		found++
+	}
+	if found != 0 {
+		t.Fatal("Should not match fields the set doesn't have")
+	}
+
+	// nor can it merge filters of another type or size
+	cuckoo := filter.Schema{{Name: "words", Type: filter.CuckooType, Bits: 512}}
+	if _, err := plain.TryInsert(schemaValue{"donk", cuckoo, nil}); err == nil {
+		t.Fatal("Should refuse values of another filter type")
+	}
+	if _, err := plain.TryInsert(schemaValue{"donk", legacySchema(16), nil}); err == nil {
+		t.Fatal("Should refuse values of another filter size")
+	}
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("Should panic inserting a value of another type")
+			}
+		}()
+		plain.Insert(schemaValue{"donk", cuckoo, nil})
+	}()
+
+	bstore := store.NewMemoryStore()
+	root := set.Persist(bstore).Root()
+
+	loaded := NewBloomSet(DeserializeTextValue, nil).Load(bstore, root)
+
+	if len(loaded.Schema()) != 1 || loaded.Schema()[0] != words[0] {
+		t.Fatal("Should load the schema persisted with the root")
+	}
+
+	results, err := loaded.TryFind(TextFilter("wonk"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _ = range results {
+		found++
+	}
+	if found != 1 {
+		t.Fatal("Should find values in the loaded set")
+	}
+
+	if !Verify(bstore, root).OK() {
+		t.Fatal("Should verify a set with a schema")
+	}
+}
+
+func TestSchemaRoot(t *testing.T) {
+	words := filter.Schema{{Name: "words", Bits: 256, Hashes: 3}}
+
+	bstore := store.NewMemoryStore()
+
+	persist := func(contents ...string) BloomSet {
+		set, _ := NewBloomSet(DeserializeTextValue, nil).WithSchema(words)
+		for _, c := range contents {
+			set = set.Insert(schemaValue{c, legacySchema(32), nil})
+		}
+		return set.Persist(bstore)
+	}
+
+	a := persist("wonk", "donk", "bonk")
+
+	// the root is written once, with the schema
+	keys, _ := bstore.Keys()
+	if len(keys) != 5 {
+		t.Fatalf("Should write 5 blocks, wrote %v", len(keys))
+	}
+
+	b := persist("plonk", "zonk")
+
+	union := a.Union(b).Persist(bstore)
+
+	reachable, errs := store.Reachable(bstore, union.Root())
+	for key := range reachable {
+		schema, _ := readRoot(bstore, key)
+		if key == union.Root() && schema == nil {
+			t.Fatal("Should keep the schema on the root")
+		}
+		if key != union.Root() && schema != nil {
+			t.Fatalf("Block %v below the root has a schema", key)
+		}
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFilterParts(t *testing.T) {
+	set := NewBloomSet(DeserializeTextValue, nil)
+
+	for i := 0; i < 1000; i++ {
+		set = set.Insert(NewTextValue(fmt.Sprintf("haystrand #%v", i)))
+	}
+
+	root := set.value.(node)
+
+	if len(root.parts) < 2 {
+		t.Fatal("Should split the filter of a large set in parts")
+	}
+
+	for _, p := range root.parts {
+		if p.MergedMaxFill(filter.EmptyFilter()) > maxPartFill {
+			t.Fatal("Should not merge parts past the fill limit")
+		}
+	}
+
+	// every leaf is in some part
+	var check func(t tree)
+	leaves := 0
+	check = func(n tree) {
+		switch n := n.(type) {
+		case node:
+			check(n.children[0])
+			check(n.children[1])
+		case leaf:
+			leaves++
+			if !mayContain(root.parts, n.filter) {
+				t.Fatal("Should cover every leaf by a part")
+			}
+		}
+	}
+	check(set.value)
+
+	if leaves != 1000 {
+		t.Fatal("Should have walked every leaf")
+	}
+
+	// saturated filters match more than their parts
+	misses := 0
+	for i := 0; i < 100; i++ {
+		query := TextFilter(fmt.Sprintf("absent %v", i))
+		if root.filter.MayContain(query) && !mayContain(root.parts, query) {
+			misses++
+		}
+	}
+	if misses == 0 {
+		t.Fatal("Should prune queries the merged filter can't")
+	}
+
+	bstore := store.NewMemoryStore()
+	set = set.Persist(bstore)
+
+	loaded := set.value.(treeRef).read().(node)
+	if len(loaded.parts) != len(root.parts) {
+		t.Fatal("Should persist the parts")
+	}
+
+	if !Verify(bstore, set.Root()).OK() {
+		t.Fatal("Should verify a set with parts")
+	}
+}
+
+func TestPartFill(t *testing.T) {
+	set := NewBloomSet(DeserializeTextValue, nil)
+	for i := 0; i < 4000; i++ {
+		set = set.Insert(NewTextValue(fmt.Sprintf("value %v of many", i)))
+	}
+
+	// every node down to the leaves keeps its parts within the limit
+	var check func(t tree, depth int)
+	check = func(n tree, depth int) {
+		if n, ok := n.(node); ok {
+			for _, p := range n.getParts() {
+				if fill := p.MergedMaxFill(filter.EmptyFilter()); fill > maxPartFill {
+					t.Fatalf("Part at depth %v is %v full", depth, fill)
+				}
+			}
+			check(n.children[0], depth+1)
+			check(n.children[1], depth+1)
+		}
+	}
+	check(set.value, 0)
+
+	// so that each part of the root rarely matches an absent value
+	parts := set.value.getParts()
+	matched := 0
+	for i := 0; i < 100; i++ {
+		query := TextFilter(fmt.Sprintf("absent%v", i))
+		for _, p := range parts {
+			if p.MayContain(query) {
+				matched++
+			}
+		}
+	}
+	if rate := float64(matched) / float64(100*len(parts)); rate > 0.15 {
+		t.Fatalf("Parts of the root match %v of absent values", rate)
+	}
+}
+
+func TestFilterEncoding(t *testing.T) {
+	schema := filter.Schema{{Name: "words", Bits: 256, Hashes: 3, Hashing: filter.Murmur3}}
+
+	// sparse filters, as for a single value
+	needle := schemaValue{"needle", schema, nil}.GetFilter()
+	elements := filterToMessage(needle)
+	for _, e := range elements {
+		if e.GetEncoding() != filter.EncodingVersion || len(e.BloomFilter) >= 32 {
+			t.Fatal("Should write sparse filters encoded")
+		}
+	}
+
+	decoded, err := elementsToFilter(elements)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.HammingDistance(needle) != 0 {
+		t.Fatal("Should decode the filter as written")
+	}
+
+	// legacy filters stay raw, to keep the hashes of legacy blocks
+	text := NewTextValue("needle").GetFilter()
+	legacy := filterToMessage(text)
+	for _, e := range legacy {
+		if e.Encoding != nil || e.Hashes != nil {
+			t.Fatal("Should write legacy filters as before")
+		}
+	}
+
+	decoded, err = elementsToFilter(legacy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.HammingDistance(text) != 0 {
+		t.Fatal("Should read raw filters")
+	}
+
+	legacy[0].Encoding = proto.Uint32(filter.EncodingVersion + 1)
+	if _, err := elementsToFilter(legacy); err != ErrUnknownEncoding {
+		t.Fatal("Should refuse unknown encodings")
+	}
+
+	// half full filters stay raw
+	saturated := filter.EmptyFilter()
+	for i := 0; i < 60; i++ {
+		saturated = saturated.Merge(schemaValue{fmt.Sprintf("word%v", i), schema, nil}.GetFilter())
+	}
+	if filterToMessage(saturated)[0].Encoding != nil {
+		t.Fatal("Should write dense filters raw")
+	}
+
+	// a leaf block is smaller than with its filter raw
+	bstore := store.NewMemoryStore()
+	set, err := NewBloomSet(DeserializeTextValue, nil).WithSchema(schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	set = set.Insert(schemaValue{"needle", schema, nil}).Persist(bstore)
+
+	root := set.Root()
+	block, err := bstore.Get(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	message := new(pb.Tree)
+	if err := proto.Unmarshal(block, message); err != nil {
+		t.Fatal(err)
+	}
+	message.Filter[0].BloomFilter = needle["words"].Bytes()
+	message.Filter[0].Encoding = nil
+	raw, _ := proto.Marshal(message)
+
+	if len(block) >= len(raw) {
+		t.Fatalf("Should write small leaf blocks, not %v bytes", len(block))
+	}
+
+	found := false
+	for v := range set.Find(needle) {
+		found = string(v.(TextValue).Content) == "needle"
+	}
+	if !found {
+		t.Fatal("Should find values by encoded filters")
+	}
+
+	if !Verify(bstore, root).OK() {
+		t.Fatal("Should verify a set with encoded filters")
+	}
+}
+
+func TestCuckooSchema(t *testing.T) {
+	schema := filter.Schema{{Name: "words", Type: filter.CuckooType, Bits: 8192}}
+
+	set, err := NewBloomSet(DeserializeTextValue, nil).WithSchema(schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 200; i++ {
+		set = set.Insert(schemaValue{fmt.Sprintf("word%v", i), schema, nil})
+	}
+
+	bstore := store.NewMemoryStore()
+	root := set.Persist(bstore).Root()
+
+	loaded := NewBloomSet(DeserializeTextValue, nil).Load(bstore, root)
+	if loaded.Schema()[0] != schema[0] {
+		t.Fatal("Should persist the type in the schema")
+	}
+
+	if _, ok := loaded.value.(treeRef).read().getFilter()["words"].(*filter.Cuckoo); !ok {
+		t.Fatal("Should read back cuckoo filters")
+	}
+
+	count := func(word string) int {
+		query := schema.New()
+		query["words"].Add([]byte(word))
+
+		values, err := loaded.TryFind(query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n := 0
+		for _ = range values {
+			n++
+		}
+		return n
+	}
+
+	if count("word42") != 1 || count("absent") != 0 {
+		t.Fatal("Should find values by cuckoo filters")
+	}
+
+	if _, err := loaded.TryFind(TextFilter("word42")); err == nil {
+		t.Fatal("Should refuse bloom queries of a cuckoo field")
+	}
+
+	if !Verify(bstore, root).OK() {
+		t.Fatal("Should verify a set with cuckoo filters")
+	}
+}
+
+// a word hashed with a key
+var keyedSchema = filter.Schema{{Name: "words", Bits: 512, Hashes: 4, Hashing: filter.Murmur3}}
+
+func keyedQuery(word string, k *filter.Key) filter.Filter {
+	return schemaValue{word, keyedSchema, k}.GetFilter()
+}
+
+func TestKeyedSet(t *testing.T) {
+	secret := []byte("correct horse battery staple")
+
+	k, err := filter.NewKey(secret, "first")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	valfunc := func(k *filter.Key) func([]byte) value.Value {
+		return func(b []byte) value.Value {
+			return schemaValue{string(b), keyedSchema, k}
+		}
+	}
+
+	set, err := NewBloomSet(valfunc(k), nil).WithSchema(keyedSchema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	set, err = set.WithKey(k)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 100; i++ {
+		set = set.Insert(schemaValue{fmt.Sprintf("word%v", i), keyedSchema, k})
+	}
+
+	if _, err := set.WithKey(k); err != ErrNotEmpty {
+		t.Fatal("Should only key empty sets")
+	}
+	if _, err := set.TryInsert(schemaValue{"plain", keyedSchema, nil}); err == nil {
+		t.Fatal("Should refuse values not keyed")
+	}
+
+	bstore := store.NewMemoryStore()
+	root := set.Persist(bstore).Root()
+
+	var archive bytes.Buffer
+	if err := set.Persist(bstore).Export(&archive); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(archive.Bytes(), secret) {
+		t.Fatal("Should not persist the secret")
+	}
+
+	loaded := NewBloomSet(nil, nil).Load(bstore, root)
+	info := loaded.KeyInfo()
+	if info == nil || info.ID != "first" {
+		t.Fatal("Should persist the key info")
+	}
+
+	again, err := filter.DeriveKey(secret, *info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded.valfunc = valfunc(again)
+
+	found := func(s BloomSet, query filter.Filter) int {
+		values, err := s.TryFind(query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n := 0
+		for _ = range values {
+			n++
+		}
+		return n
+	}
+
+	if found(loaded, keyedQuery("word42", again)) != 1 {
+		t.Fatal("Should find keyed words with the key")
+	}
+
+	plain := keyedSchema.New()
+	plain["words"].Add([]byte("word42"))
+	if _, err := loaded.TryFind(plain); err == nil {
+		t.Fatal("Should refuse queries not keyed")
+	}
+
+	// rotating the key
+	second, _ := filter.NewKey(secret, "second")
+	rekeyed, err := loaded.Rekey(second, valfunc(second))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rekeyed.KeyInfo().ID != "second" || rekeyed.value.count() != 100 {
+		t.Fatal("Should rebuild the set with the new key")
+	}
+	if found(rekeyed, keyedQuery("word42", second)) != 1 {
+		t.Fatal("Should find words with the new key")
+	}
+	if _, err := rekeyed.TryFind(keyedQuery("word42", again)); err == nil {
+		t.Fatal("Should refuse queries with the old key")
+	}
+}
+
+// counts the blocks read
+type countingStore struct {
+	store.BlockStore
+	gets int
+	keys map[store.Key]int
+}
+
+func (s *countingStore) Get(key store.Key) ([]byte, error) {
+	s.gets++
+	if s.keys != nil {
+		s.keys[key]++
+	}
+	return s.BlockStore.Get(key)
+}
+
+func TestEstimateMatches(t *testing.T) {
+	set := NewBloomSet(DeserializeTextValue, nil)
+
+	for i := 0; i < 1000; i++ {
+		set = set.Insert(NewTextValue(fmt.Sprintf("haystrand #%v", i)))
+	}
+	set = set.Insert(NewTextValue("needle"))
+
+	queries := []struct {
+		filter   filter.Filter
+		min, max float64
+	}{
+		{TextFilter("haystrand"), 950, 1050},
+		{TextFilter("needle"), 1, 2},
+		{TextFilter("absent"), 0, 1},
+	}
+
+	// exact in memory
+	for _, q := range queries {
+		found := 0
+		for _ = range set.Find(q.filter) {
+			found++
+		}
+		if set.EstimateMatches(q.filter) != float64(found) {
+			t.Fatal("Should count the matching leaves in memory")
+		}
+	}
+
+	bstore := &countingStore{BlockStore: store.NewMemoryStore()}
+	root := set.Persist(bstore).Root()
+	loaded := NewBloomSet(DeserializeTextValue, nil).Load(bstore, root)
+
+	stats, err := loaded.Stats(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, q := range queries {
+		bstore.gets = 0
+		estimate := loaded.EstimateMatches(q.filter)
+		if estimate < q.min || estimate > q.max {
+			t.Fatalf("Estimated %v matches, expected %v to %v", estimate, q.min, q.max)
+		}
+		if bstore.gets >= stats.Nodes["node"] {
+			t.Fatalf("Should read fewer blocks than nodes, read %v", bstore.gets)
+		}
+	}
+
+	if (BloomSet{}).EstimateMatches(TextFilter("needle")) != 0 {
+		t.Fatal("Should estimate no matches in an empty set")
+	}
+}
+
+func TestEstimateMatchesSkewed(t *testing.T) {
+	set := NewBloomSet(DeserializeTextValue, nil)
+	for i := 0; i < 500; i++ {
+		set = set.Insert(NewTextValue(fmt.Sprintf("haystrand #%v", i)))
+	}
+
+	// a long spine of small groups above a balanced haystack, one
+	// needle in each group
+	skewed := set.value
+	for i := 0; i < 50; i++ {
+		group := NewBloomSet(DeserializeTextValue, nil).
+			Insert(NewTextValue(fmt.Sprintf("needle #%v", i))).
+			Insert(NewTextValue(fmt.Sprintf("straw #%v", i))).
+			Insert(NewTextValue(fmt.Sprintf("straw #%v twice", i)))
+		skewed = newNode(group.value, skewed)
+	}
+
+	bstore := store.NewMemoryStore()
+	loaded := set.with(skewed).Persist(bstore)
+
+	queries := []struct {
+		filter   filter.Filter
+		expected float64
+	}{
+		{TextFilter("needle"), 50},
+		{TextFilter("absent"), 0},
+	}
+
+	for _, q := range queries {
+		estimate := loaded.EstimateMatches(q.filter)
+		if math.Abs(estimate-q.expected) > 1+q.expected/5 {
+			t.Fatalf("Estimated %v matches, expected about %v", estimate, q.expected)
+		}
+	}
+}
+
+func TestEstimateMatchesClustered(t *testing.T) {
+	hay := NewBloomSet(DeserializeTextValue, nil)
+	straw := NewBloomSet(DeserializeTextValue, nil)
+	for i := 0; i < 300; i++ {
+		hay = hay.Insert(NewTextValue(fmt.Sprintf("haystrand #%v", i)))
+		straw = straw.Insert(NewTextValue(fmt.Sprintf("straw #%v", i)))
+	}
+
+	// every match in one half of the tree
+	bstore := &countingStore{BlockStore: store.NewMemoryStore()}
+	root := hay.with(newNode(hay.value, straw.value)).Persist(bstore).Root()
+	loaded := NewBloomSet(DeserializeTextValue, nil).Load(bstore, root)
+
+	bstore.keys = map[store.Key]int{}
+	estimate := loaded.EstimateMatches(TextFilter("haystrand"))
+	if math.Abs(estimate-300) > 1+300/5 {
+		t.Fatalf("Estimated %v matches, expected about 300", estimate)
+	}
+
+	for key := range bstore.keys {
+		block, _ := bstore.Get(key)
+		message := new(pb.Tree)
+		proto.Unmarshal(block, message)
+		if message.GetType() == pb.Tree_Leaf {
+			t.Fatal("Should estimate without reading leaves")
+		}
+	}
+}
+
+// a word hashed as the schema says, with the key if there is one
+type schemaValue struct {
+	word   string
+	schema filter.Schema
+	key    *filter.Key
+}
+
+func (v schemaValue) Serialize() []byte {
+	return []byte(v.word)
+}
+
+// an empty word leaves the field empty
+func (v schemaValue) GetFilter() filter.Filter {
+	f := v.schema.New()
+	if v.key != nil {
+		f = f.Keyed(v.key)
+	}
+	if v.word != "" {
+		f["words"].Add([]byte(v.word))
+	}
+	return f
+}
+
+func TestMurmur3Schema(t *testing.T) {
+	schema := filter.Schema{{Name: "words", Bits: 512, Hashes: 5, Hashing: filter.Murmur3}}
+
+	set, err := NewBloomSet(DeserializeTextValue, nil).WithSchema(schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 100; i++ {
+		set = set.Insert(schemaValue{fmt.Sprintf("word%v", i), schema, nil})
+	}
+
+	// legacy hashing doesn't match the schema
+	if _, err := set.TryFind(TextFilter("word1")); err == nil {
+		t.Fatal("Should refuse queries hashed differently")
+	}
+
+	bstore := store.NewMemoryStore()
+	root := set.Persist(bstore).Root()
+
+	loaded := NewBloomSet(DeserializeTextValue, nil).Load(bstore, root)
+
+	if loaded.Schema()[0] != schema[0] {
+		t.Fatal("Should persist the hashing in the schema")
+	}
+
+	query := schema.New()
+	query["words"].Add([]byte("word42"))
+
+	found := false
+	for v := range loaded.Find(query) {
+		if v.(TextValue).Content == "word42" {
+			found = true
+		}
+	}
+
+	if !found {
+		t.Fatal("Should find the word in the loaded set")
+	}
+
+	if !Verify(bstore, root).OK() {
+		t.Fatal("Should verify a set with murmur3 filters")
+	}
+}
+
+func BenchmarkPersistedFind(b *testing.B) {
+	hashings := []struct {
+		name    string
+		hashing filter.Hashing
+	}{
+		{"legacy", filter.Legacy},
+		{"blocked", filter.Blocked},
+	}
+
+	for _, h := range hashings {
+		schema := filter.Schema{{Name: "words", Bits: 2048, Hashes: 3, Hashing: h.hashing}}
+
+		set, _ := NewBloomSet(DeserializeTextValue, nil).WithSchema(schema)
+		for i := 0; i < 5000; i++ {
+			set = set.Insert(schemaValue{fmt.Sprintf("word%v", i), schema, nil})
+		}
+
+		bstore := store.NewMemoryStore()
+		root := set.Persist(bstore).Root()
+
+		queries := make([]filter.Filter, 100)
+		for i := range queries {
+			queries[i] = schema.New()
+			queries[i]["words"].Add([]byte(fmt.Sprintf("word%v", i*50)))
+		}
+
+		b.Run(h.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				loaded := set.Load(bstore, root)
+				for _ = range loaded.Find(queries[i%len(queries)]) {
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkInsert(b *testing.B) {
+	for _, count := range []int{1000, 16000} {
+		b.Run(fmt.Sprint(count), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				set := NewBloomSet(DeserializeTextValue, nil)
+				for j := 0; j < count; j++ {
+					set = set.Insert(NewTextValue(fmt.Sprintf("haystrand #%v", j)))
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,105 @@
+package bloomset
+
+import (
+	. "github.com/krl/bloomtree/value"
+)
+
+func refKey(t tree) (string, bool) {
+	if r, ok := t.(treeRef); ok {
+		return string(r.key), true
+	}
+	return "", false
+}
+
+func refKeys(items []tree) map[string]int {
+	keys := map[string]int{}
+	for _, t := range items {
+		if k, ok := refKey(t); ok {
+			keys[k]++
+		}
+	}
+	return keys
+}
+
+// expand replaces every subtree not shared with the other side by its
+// children, loading it if needed
+func expand(items []tree, other map[string]int) ([]tree, bool) {
+	expanded := make([]tree, 0, len(items))
+	changed := false
+
+	for _, t := range items {
+		if k, ok := refKey(t); ok {
+			if other[k] > 0 {
+				expanded = append(expanded, t)
+				continue
+			}
+			t = t.(treeRef).read()
+			changed = true
+		}
+
+		switch n := t.(type) {
+		case node:
+			expanded = append(expanded, n.children[0], n.children[1])
+			changed = true
+		case leaf:
+			expanded = append(expanded, n)
+		}
+	}
+	return expanded, changed
+}
+
+// unmatched returns the leaves of the subtrees that are not matched by a
+// subtree with the same hash on the other side
+func unmatched(items []tree, other map[string]int) map[string]int {
+	result := map[string]int{}
+
+	for _, t := range items {
+		if k, ok := refKey(t); ok && other[k] > 0 {
+			other[k]--
+			continue
+		}
+		walk(t, 0, &Shape{}, func(l leaf) {
+			result[string(l.bytes)]++
+		})
+	}
+	return result
+}
+
+// Diff compares two versions of a set, returning the values only
+// found in the new version and the values only found in the old one.
+// Subtrees with the same hash in both versions are never loaded.
+func Diff(old, new BloomSet) (added []Value, removed []Value) {
+	a, b := []tree{}, []tree{}
+	if old.value != nil {
+		a = append(a, old.value)
+	}
+	if new.value != nil {
+		b = append(b, new.value)
+	}
+
+	for {
+		var changedA, changedB bool
+		a, changedA = expand(a, refKeys(b))
+		b, changedB = expand(b, refKeys(a))
+		if !changedA && !changedB {
+			break
+		}
+	}
+
+	oldLeaves := unmatched(a, refKeys(b))
+	newLeaves := unmatched(b, refKeys(a))
+
+	for bytes, n := range newLeaves {
+		for i := oldLeaves[bytes]; i < n; i++ {
+			added = append(added, new.valfunc([]byte(bytes)))
+		}
+	}
+
+	for bytes, n := range oldLeaves {
+		for i := newLeaves[bytes]; i < n; i++ {
+			removed = append(removed, old.valfunc([]byte(bytes)))
+		}
+	}
+
+	return added, removed
+}
@@ -0,0 +1,129 @@
+package bloomset
+
+import (
+	proto "code.google.com/p/goprotobuf/proto"
+	pb "github.com/krl/bloomtree/bloomset/pb"
+	"github.com/krl/bloomtree/dump"
+	"github.com/krl/bloomtree/filter"
+	"github.com/krl/bloomtree/store"
+	"io"
+)
+
+// fill returns the ratio of set bits in every field of the filter
+func fill(f filter.Filter) map[string]float64 {
+	ratios := map[string]float64{}
+	for name, field := range f {
+		ratios[name] = filter.Filter{name: field}.Fill()
+	}
+	return ratios
+}
+
+// describe dumps the tree t at the given depth, down to the depth
+// limit. A negative limit dumps the whole tree.
+func describe(t tree, depth int, limit int) (dump.Node, error) {
+	var children []tree
+	var d dump.Node
+
+	switch n := t.(type) {
+	case node:
+		d = dump.Node{Type: "node", Count: n.count(), Fill: fill(n.filter)}
+		children = n.children[:]
+	case leaf:
+		d = dump.Node{Type: "leaf", Count: 1, Fill: fill(n.filter), Preview: dump.Preview(n.bytes)}
+	case treeRef:
+		// nodes in the cache are loaded, but still persisted
+		if cached, ok := n.cached(); ok {
+			d, err := describe(cached, depth, limit)
+			d.Key = n.key.String()
+			return d, err
+		}
+
+		if depth == limit {
+			return dump.Node{Type: "treeRef", Key: n.key.String()}, nil
+		}
+
+		// read the block itself, so that children stay unloaded
+		block, err := n.store.Get(n.key)
+		if err != nil {
+			return dump.Node{}, err
+		}
+		message := new(pb.Tree)
+		err = proto.Unmarshal(block, message)
+		if err != nil {
+			return dump.Node{}, err
+		}
+
+		f, err := filterFromMessage(message)
+		if err != nil {
+			return dump.Node{}, err
+		}
+
+		d = dump.Node{
+			Key:   n.key.String(),
+			Count: message.GetCount(),
+			Fill:  fill(f),
+		}
+
+		switch message.GetType() {
+		case pb.Tree_Leaf:
+			d.Type = "leaf"
+			d.Count = 1
+			d.Preview = dump.Preview(message.Data)
+		case pb.Tree_Node:
+			d.Type = "node"
+		}
+
+		if message.GetType() == pb.Tree_Node {
+			links, err := store.TreeLinks(n.store, n.key, message.Links)
+			if err != nil {
+				return dump.Node{}, err
+			}
+			for _, link := range links {
+				children = append(children, n.ref(link))
+			}
+		}
+	}
+
+	if depth == limit {
+		return d, nil
+	}
+
+	for _, c := range children {
+		child, err := describe(c, depth+1, limit)
+		if err != nil {
+			return dump.Node{}, err
+		}
+		d.Children = append(d.Children, child)
+	}
+	return d, nil
+}
+
+// describeRoot dumps the set down to the depth limit, or returns nil
+// for an empty set
+func (s BloomSet) describeRoot(limit int) (*dump.Node, error) {
+	if s.value == nil {
+		return nil, nil
+	}
+	d, err := describe(s.value, 0, limit)
+	return &d, err
+}
+
+// DumpJSON writes the structure of the set to w as JSON, down to the
+// given depth. A negative depth dumps the whole set.
+func (s BloomSet) DumpJSON(w io.Writer, depth int) error {
+	root, err := s.describeRoot(depth)
+	if err != nil {
+		return err
+	}
+	return dump.WriteJSON(w, root)
+}
+
+// DumpDOT writes the structure of the set to w as a Graphviz graph,
+// down to the given depth. A negative depth dumps the whole set.
+func (s BloomSet) DumpDOT(w io.Writer, depth int) error {
+	root, err := s.describeRoot(depth)
+	if err != nil {
+		return err
+	}
+	return dump.WriteDOT(w, "bloomset", root)
+}
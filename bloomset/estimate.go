@@ -0,0 +1,126 @@
+package bloomset
+
+import (
+	"github.com/krl/bloomtree/filter"
+	"math"
+)
+
+// persisted subtrees of up to this many values are not read further
+// when estimating, as their children are mostly leaves
+const estimateGroup = 4
+
+// subtrees of at least this many values, and at most half of the
+// region they are in, are a region of their own when estimating
+const estimateRegion = 64
+
+// EstimateMatches estimates how many values a query returns. It walks
+// the nodes the query may match, counting leaves held in memory.
+// Persisted nodes of a few values are not read further, and neither
+// are persisted leaves, known by the counts their parents record, so
+// that no leaf blocks are read.
+//
+// A group of n values matches if any of them does, and if a value
+// matches with the chance p, a group does with the chance
+// 1 - (1 - p)^n, which the share of values in matching groups
+// estimates. A matching group then holds np / (1 - (1 - p)^n)
+// matching values, from 1 for rare queries to n for queries every
+// value matches.
+//
+// So that matches clustered in part of the tree don't skew the chance
+// for the rest, p is fitted to the groups of each region of the tree
+// apart, from the share of the values of the region in them.
+func (s BloomSet) EstimateMatches(f filter.Filter) float64 {
+	if s.value == nil {
+		return 0
+	}
+
+	e := estimate{query: f}
+	e.region(s.value)
+	return e.matches
+}
+
+type estimate struct {
+	query   filter.Filter
+	matches float64
+}
+
+// a region is a subtree, less the smaller regions in it
+type region struct {
+	size uint64
+
+	// values neither in leaves seen nor in smaller regions
+	values uint64
+
+	// sizes of the groups of persisted values matching
+	groups []uint64
+}
+
+// region walks a subtree as a region of its own, and adds the matches
+// estimated for it
+func (e *estimate) region(t tree) {
+	r := &region{size: t.count(), values: t.count()}
+	e.walk(t, r)
+
+	if len(r.groups) == 0 {
+		return
+	}
+
+	grouped := uint64(0)
+	for _, n := range r.groups {
+		grouped += n
+	}
+	share := math.Min(1, float64(grouped)/float64(r.values))
+	size := float64(grouped) / float64(len(r.groups))
+	p := 1 - math.Pow(1-share, 1/size)
+
+	for _, n := range r.groups {
+		if p == 0 {
+			e.matches++
+			continue
+		}
+		e.matches += float64(n) * p / (1 - math.Pow(1-p, float64(n)))
+	}
+}
+
+func (e *estimate) walk(t tree, r *region) {
+	switch t := t.(type) {
+	case leaf:
+		r.values--
+		if t.filter.MayContain(e.query) {
+			e.matches++
+		}
+
+	case node:
+		if !mayContain(t.getParts(), e.query) {
+			return
+		}
+
+		count := t.count()
+		if count >= estimateRegion && count <= r.size/2 {
+			r.values -= count
+			e.region(t)
+			return
+		}
+
+		_, ref0 := t.children[0].(treeRef)
+		_, ref1 := t.children[1].(treeRef)
+		if count <= estimateGroup && (ref0 || ref1) {
+			r.groups = append(r.groups, count)
+			return
+		}
+		e.walk(t.children[0], r)
+		e.walk(t.children[1], r)
+
+	case treeRef:
+		if cached, ok := t.cached(); ok {
+			e.walk(cached, r)
+			return
+		}
+		// a leaf its parent matched, but not read
+		if t.m_count == 1 {
+			r.groups = append(r.groups, 1)
+			return
+		}
+		e.walk(t.read(), r)
+	}
+}
@@ -3,18 +3,24 @@ package bloomset
 import (
 	"bytes"
 	proto "code.google.com/p/goprotobuf/proto"
-	context "github.com/ipfs/go-ipfs/Godeps/_workspace/src/golang.org/x/net/context"
-	mdag "github.com/ipfs/go-ipfs/merkledag"
+	"container/list"
+	"errors"
 	pb "github.com/krl/bloomtree/bloomset/pb"
 	"github.com/krl/bloomtree/filter"
+	"github.com/krl/bloomtree/store"
+	"sort"
+	"sync"
 )
 
 type tree interface {
-	insert(leaf) tree
+	insert(leaf, InsertPolicy) tree
 	remove(leaf) (tree, bool)
 	getFilter() filter.Filter
+	getParts() []filter.Filter
+	getFilled() []string
+	count() uint64
 	find(filter.Filter, chan []byte) tree
-	persist(dserv mdag.DAGService) treeRef
+	persist(store.BlockStore) treeRef
 
 	// for tests only
 	getLeavesDepth(int) []int
@@ -24,6 +30,9 @@ type tree interface {
 type node struct {
 	children [2]tree
 	filter   filter.Filter
+	parts    []filter.Filter
+	filled   []string
+	m_count  uint64
 }
 
 type leaf struct {
@@ -32,13 +41,86 @@ type leaf struct {
 }
 
 func newNode(c1 tree, c2 tree) tree {
-	return node{
+	n := node{
 		children: [2]tree{c1, c2},
 		filter:   c1.getFilter().Merge(c2.getFilter()),
+		filled:   both(c1.getFilled(), c2.getFilled()),
+		m_count:  c1.count() + c2.count(),
 	}
+
+	// parts within the fill limit would all merge into the filter
+	if n.filter.MergedMaxFill(filter.EmptyFilter()) > maxPartFill {
+		n.parts = mergeParts(c1.getParts(), c2.getParts())
+	}
+	return n
+}
+
+// Merging all the filters of a subtree fills them up, until near the
+// root they match everything. So the filter of a node is also kept as
+// parts, each the merged filters of a group of leaves. Parts are
+// merged as long as no field gets fuller than this, which bounds the
+// false positive rate of each part. Every leaf is covered by one part,
+// so a node may contain a filter if any of its parts does.
+const maxPartFill = 0.5
+
+// A part at most half the fill limit is still open. Two open parts
+// always merge within the limit, as merging at most adds their fills.
+// The open part of a node, if any, is kept last, so that merging the
+// parts of two nodes only merges their last parts, and takes time
+// linear in the number of parts. The number of parts grows with the
+// subtree, as it has to for the fill to stay bounded.
+func mergeParts(p1, p2 []filter.Filter) []filter.Filter {
+	closed := make([]filter.Filter, 0, len(p1)+len(p2))
+	open := make([]filter.Filter, 0, 2)
+
+	for _, parts := range [][]filter.Filter{p1, p2} {
+		last := len(parts) - 1
+		closed = append(closed, parts[:last]...)
+		if isOpen(parts[last]) {
+			open = append(open, parts[last])
+		} else {
+			closed = append(closed, parts[last])
+		}
+	}
+
+	if len(open) == 2 {
+		open = []filter.Filter{open[0].Merge(open[1])}
+	}
+	return append(closed, open...)
+}
+
+func isOpen(part filter.Filter) bool {
+	return part.MergedMaxFill(filter.EmptyFilter()) <= maxPartFill/2
 }
 
-func (l1 leaf) insert(l2 leaf) tree {
+// both returns the names in both sorted lists
+func both(n1, n2 []string) []string {
+	names := []string{}
+	for len(n1) > 0 && len(n2) > 0 {
+		switch {
+		case n1[0] < n2[0]:
+			n1 = n1[1:]
+		case n1[0] > n2[0]:
+			n2 = n2[1:]
+		default:
+			names = append(names, n1[0])
+			n1, n2 = n1[1:], n2[1:]
+		}
+	}
+	return names
+}
+
+// mayContain tells if any of the parts may contain the filter
+func mayContain(parts []filter.Filter, f filter.Filter) bool {
+	for _, p := range parts {
+		if p.MayContain(f) {
+			return true
+		}
+	}
+	return false
+}
+
+func (l1 leaf) insert(l2 leaf, _ InsertPolicy) tree {
 	if bytes.Equal(l1.bytes, l2.bytes) {
 		return l1 // store no duplicates
 	}
@@ -57,6 +139,18 @@ func (l leaf) getFilter() filter.Filter {
 	return l.filter
 }
 
+func (l leaf) getParts() []filter.Filter {
+	return []filter.Filter{l.filter}
+}
+
+func (l leaf) getFilled() []string {
+	return l.filter.Filled()
+}
+
+func (l leaf) count() uint64 {
+	return 1
+}
+
 func (l leaf) find(fs filter.Filter, c chan []byte) tree {
 	// TODO check for false positives
 	c <- l.bytes
@@ -75,36 +169,23 @@ func (l leaf) countUnreferencedNodes() int {
 
 // nodes
 
-func (n node) insert(l leaf) tree {
+func (n node) insert(l leaf, policy InsertPolicy) tree {
 
-	// find the child node with the lowest hamming distance
-	// and insert in that node
-	// if the inserted leaf lacks a specific filter
-	// this does not count towards the potential conflict
+	// let the policy pick the child to insert into
 
-	leaffilter := l.getFilter()
+	branches := [2]Branch{}
 
-	child0dist := n.children[0].getFilter().HammingDistance(leaffilter)
-	child1dist := n.children[1].getFilter().HammingDistance(leaffilter)
-
-	var insert int
-
-	if child0dist == child1dist {
-		if child0dist%2 == 0 {
-			insert = 0
-		} else {
-			insert = 1
+	for i := 0; i < 2; i++ {
+		branches[i] = Branch{
+			Filter: n.children[i].getFilter(),
+			Count:  n.children[i].count(),
 		}
-	} else if child0dist < child1dist {
-		insert = 0
-	} else {
-		insert = 1
 	}
 
-	if insert == 0 {
-		return newNode(n.children[0].insert(l), n.children[1])
+	if policy.Choose(branches, l.getFilter()) == 0 {
+		return newNode(n.children[0].insert(l, policy), n.children[1])
 	} else {
-		return newNode(n.children[0], n.children[1].insert(l))
+		return newNode(n.children[0], n.children[1].insert(l, policy))
 	}
 }
 
@@ -115,7 +196,7 @@ func (n node) remove(l leaf) (tree, bool) {
 		var res tree
 		var success bool
 
-		if n.children[i].getFilter().MayContain(lfilt) {
+		if mayContain(n.children[i].getParts(), lfilt) {
 			res, success = n.children[i].remove(l)
 		}
 
@@ -137,9 +218,29 @@ func (n node) getFilter() filter.Filter {
 	return n.filter
 }
 
+func (n node) getParts() []filter.Filter {
+	if len(n.parts) == 0 {
+		return []filter.Filter{n.filter}
+	}
+	return n.parts
+}
+
+// getFilled returns the fields every leaf below has keys in
+func (n node) getFilled() []string {
+	return n.filled
+}
+
+func (n node) count() uint64 {
+	// blocks written before counts were stored have none
+	if n.m_count == 0 {
+		return n.children[0].count() + n.children[1].count()
+	}
+	return n.m_count
+}
+
 func (n node) find(fs filter.Filter, c chan []byte) tree {
 	for i := 0; i < 2; i++ {
-		if n.children[i].getFilter().MayContain(fs) {
+		if mayContain(n.children[i].getParts(), fs) {
 			n.children[i] = n.children[i].find(fs, c)
 		}
 	}
@@ -168,87 +269,310 @@ func (n node) countUnreferencedNodes() int {
 
 // persistance
 
-func refFromTree(t tree, dserv mdag.DAGService) treeRef {
+func refFromTree(t tree, s store.BlockStore) treeRef {
+	return putMessage(messageFromTree(t, s), s)
+}
+
+// messageFromTree persists the children of t, and returns the message
+// for its block
+func messageFromTree(t tree, s store.BlockStore) *pb.Tree {
 
 	var datatype pb.Tree_DataType
 
-	mdagnode := new(mdag.Node)
 	message := new(pb.Tree)
 
-	switch s := t.(type) {
+	switch n := t.(type) {
 	case node:
 		datatype = pb.Tree_Node
-		mdagnode.AddRawLink("0", s.children[0].persist(dserv).link)
-		mdagnode.AddRawLink("1", s.children[1].persist(dserv).link)
+		for _, c := range n.children {
+			message.Links = append(message.Links, []byte(c.persist(s).key))
+			message.Counts = append(message.Counts, c.count())
+		}
+		message.Filled = n.filled
 	case leaf:
 		datatype = pb.Tree_Leaf
-		message.Data = s.bytes
+		message.Data = n.bytes
 	}
 
-	filtermap := t.getFilter()
-
-	filter := make([]*pb.FilterElement, 0, len(filtermap))
+	message.Count = proto.Uint64(t.count())
+	message.Filter = filterToMessage(t.getFilter())
 
-	for k, v := range filtermap {
-		name := k // need to provide unchanging pointer
-		f := &pb.FilterElement{}
-		f.Name = &name
-		f.BloomFilter = v.GetBytes()
-		filter = append(filter, f)
+	// a single part is the same as the filter
+	if parts := t.getParts(); len(parts) > 1 {
+		for _, p := range parts {
+			message.Parts = append(message.Parts, &pb.Part{Filter: filterToMessage(p)})
+		}
 	}
 
-	message.Filter = filter
 	message.Type = &datatype
+	return message
+}
 
+func putMessage(message *pb.Tree, s store.BlockStore) treeRef {
 	marshalled, _ := proto.Marshal(message)
-	mdagnode.Data = marshalled
 
-	_, err := dserv.Add(mdagnode)
+	key, err := s.Put(marshalled)
 	if err != nil {
 		panic(err)
 	}
 
-	link, err := mdag.MakeLink(mdagnode)
+	ref := newRef(key, s)
+	ref.m_count = message.GetCount()
+	return ref
+}
+
+func (n node) persist(s store.BlockStore) treeRef {
+	return refFromTree(n, s)
+}
+
+func (l leaf) persist(s store.BlockStore) treeRef {
+	return refFromTree(l, s)
+}
+
+func filterToMessage(filtermap filter.Filter) []*pb.FilterElement {
+	// sorted, so that equal trees get equal hashes
+	names := make([]string, 0, len(filtermap))
+	for k := range filtermap {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	elements := make([]*pb.FilterElement, 0, len(filtermap))
+
+	for _, k := range names {
+		name := k // need to provide unchanging pointer
+		m := filtermap[k]
+		f := &pb.FilterElement{}
+		f.Name = &name
+		f.BloomFilter = m.Bytes()
+
+		switch m := m.(type) {
+		case *filter.Bloom:
+			// legacy filters are written raw as before, to keep their hashes
+			if m.IsLegacy() {
+				break
+			}
+			f.Hashes = proto.Uint32(uint32(m.Hashes()))
+			f.Hashing = proto.Uint32(uint32(m.Hashing()))
+			encode(f)
+		case *filter.Cuckoo:
+			encode(f)
+			f.Type = proto.Uint32(uint32(filter.CuckooType))
+		default:
+			panic("can't persist filters of an unknown type")
+		}
+		elements = append(elements, f)
+	}
+	return elements
+}
+
+// encode stores the bits of a filter element encoded, when sparse
+// enough to come out smaller
+func encode(f *pb.FilterElement) {
+	if encoded := filter.EncodeBits(f.BloomFilter); len(encoded) < len(f.BloomFilter) {
+		f.BloomFilter = encoded
+		f.Encoding = proto.Uint32(filter.EncodingVersion)
+	}
+}
+
+var (
+	ErrUnknownEncoding = errors.New("unknown filter encoding")
+	ErrUnknownType     = errors.New("unknown filter type")
+	ErrDuplicateField  = errors.New("filter field given twice")
+)
+
+func elementsToFilter(elements []*pb.FilterElement) (filter.Filter, error) {
+	f := filter.EmptyFilter()
+
+	for _, v := range elements {
+		if f[v.GetName()] != nil {
+			return nil, ErrDuplicateField
+		}
+
+		bits := v.BloomFilter
+
+		switch v.GetEncoding() {
+		case 0:
+			// raw, as all filters were written before encodings
+		case filter.EncodingVersion:
+			var err error
+			bits, err = filter.DecodeBits(bits)
+			if err != nil {
+				return nil, err
+			}
+		default:
+			return nil, ErrUnknownEncoding
+		}
 
-	return treeRef{
-		link:  link,
-		dserv: dserv,
+		switch filter.Type(v.GetType()) {
+		case filter.BloomType:
+			b := filter.BloomFromBytes(bits, int(v.GetHashes()), filter.Hashing(v.GetHashing()))
+			f = f.AddField(v.GetName(), b)
+		case filter.CuckooType:
+			c, err := filter.CuckooFromBytes(bits)
+			if err != nil {
+				return nil, err
+			}
+			f = f.AddField(v.GetName(), c)
+		default:
+			return nil, ErrUnknownType
+		}
 	}
+	return f, nil
 }
 
-func (n node) persist(dserv mdag.DAGService) treeRef {
-	return refFromTree(n, dserv)
+func filterFromMessage(message *pb.Tree) (filter.Filter, error) {
+	return elementsToFilter(message.Filter)
 }
 
-func (l leaf) persist(dserv mdag.DAGService) treeRef {
-	return refFromTree(l, dserv)
+// partsFromMessage returns the parts of a node, which are just its
+// filter if it has no parts, as for blocks written before parts
+func partsFromMessage(message *pb.Tree) ([]filter.Filter, error) {
+	if len(message.Parts) == 0 {
+		f, err := filterFromMessage(message)
+		return []filter.Filter{f}, err
+	}
+
+	parts := make([]filter.Filter, len(message.Parts))
+	for i, p := range message.Parts {
+		f, err := elementsToFilter(p.Filter)
+		if err != nil {
+			return nil, err
+		}
+		parts[i] = f
+	}
+	return parts, nil
 }
 
 // Operations on tree references
 
+// A treeRef points to a persisted subtree. Refs read from the same
+// root share a cache of the nodes read last, so that blocks in use are
+// read and decoded once, without keeping the whole tree in memory.
 type treeRef struct {
-	link  *mdag.Link
-	dserv mdag.DAGService
+	key   store.Key
+	store store.BlockStore
+	cache *nodeCache
+
+	// as recorded by the parent, none for nodes written before
+	m_count uint64
+}
+
+// nodes of a persisted set kept decoded
+const cachedNodes = 4096
+
+type nodeCache struct {
+	sync.Mutex
+	size    int
+	entries map[store.Key]*list.Element
+	// most recently used first
+	order *list.List
+}
+
+type cacheEntry struct {
+	key  store.Key
+	tree tree
+	// counts of legacy blocks load their subtree, so they are kept
+	count uint64
+}
+
+func newCache(size int) *nodeCache {
+	return &nodeCache{
+		size:    size,
+		entries: map[store.Key]*list.Element{},
+		order:   list.New(),
+	}
+}
+
+// get returns the entry of a cached node, which is then the most
+// recently used
+func (c *nodeCache) get(key store.Key) (cacheEntry, bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	e, ok := c.entries[key]
+	if !ok {
+		return cacheEntry{}, false
+	}
+	c.order.MoveToFront(e)
+	return *e.Value.(*cacheEntry), true
+}
+
+// put caches a node, dropping the least recently used past the size
+func (c *nodeCache) put(key store.Key, t tree) {
+	c.Lock()
+	defer c.Unlock()
+
+	if e, ok := c.entries[key]; ok {
+		c.order.MoveToFront(e)
+		return
+	}
+
+	c.entries[key] = c.order.PushFront(&cacheEntry{key: key, tree: t})
+	for c.order.Len() > c.size {
+		last := c.order.Back()
+		c.order.Remove(last)
+		delete(c.entries, last.Value.(*cacheEntry).key)
+	}
+}
+
+// keepCount keeps the count of a node while it is cached
+func (c *nodeCache) keepCount(key store.Key, count uint64) {
+	c.Lock()
+	defer c.Unlock()
+
+	if e, ok := c.entries[key]; ok {
+		e.Value.(*cacheEntry).count = count
+	}
+}
+
+func newRef(key store.Key, s store.BlockStore) treeRef {
+	return treeRef{key: key, store: s, cache: newCache(cachedNodes)}
+}
+
+// ref returns a ref to another block of the tree, sharing the cache
+func (r treeRef) ref(key store.Key) treeRef {
+	return treeRef{key: key, store: r.store, cache: r.cache}
+}
+
+// cached returns the node if it is in the cache, without reading it
+func (r treeRef) cached() (tree, bool) {
+	if r.cache == nil {
+		return nil, false
+	}
+	entry, ok := r.cache.get(r.key)
+	return entry.tree, ok
 }
 
 func (r treeRef) read() tree {
-	mdagnode, err := r.link.GetNode(context.Background(), r.dserv)
+	if t, ok := r.cached(); ok {
+		return t
+	}
+
+	t := r.decode()
+	if r.cache != nil {
+		r.cache.put(r.key, t)
+	}
+	return t
+}
+
+func (r treeRef) decode() tree {
+	block, err := r.store.Get(r.key)
 	if err != nil {
 		panic(err)
 	}
 
 	unmarshalled := new(pb.Tree)
 
-	err = proto.Unmarshal(mdagnode.Data, unmarshalled)
+	err = proto.Unmarshal(block, unmarshalled)
 	if err != nil {
 		panic(err)
 	}
 
 	// both types have filters
-	filter := filter.EmptyFilter()
-
-	for _, v := range unmarshalled.Filter {
-		filter = filter.AddBloom(*v.Name, v.BloomFilter)
+	filter, err := filterFromMessage(unmarshalled)
+	if err != nil {
+		panic(err)
 	}
 
 	// switch on the rest
@@ -261,22 +585,41 @@ func (r treeRef) read() tree {
 		}
 
 	case pb.Tree_Node:
-		child0, err := mdagnode.GetNodeLink("0")
-		if err != nil {
-			panic(err)
+		links := make([]store.Key, len(unmarshalled.Links))
+		for i, link := range unmarshalled.Links {
+			links[i] = store.Key(link)
+		}
+
+		// trees written before blocks held the keys of their
+		// children link to them as merkledag nodes
+		if len(links) == 0 {
+			links, err = store.LegacyLinks(r.store, r.key)
+			if err != nil {
+				panic(err)
+			}
+		}
+
+		if len(links) != 2 {
+			panic("node without 2 links")
+		}
+
+		refs := [2]treeRef{r.ref(links[0]), r.ref(links[1])}
+		if counts := unmarshalled.Counts; len(counts) == 2 {
+			refs[0].m_count, refs[1].m_count = counts[0], counts[1]
 		}
+		children := [2]tree{refs[0], refs[1]}
 
-		child1, err := mdagnode.GetNodeLink("1")
+		parts, err := partsFromMessage(unmarshalled)
 		if err != nil {
 			panic(err)
 		}
 
 		return node{
-			children: [2]tree{
-				treeRef{link: child0, dserv: r.dserv},
-				treeRef{link: child1, dserv: r.dserv},
-			},
-			filter: filter,
+			children: children,
+			filter:   filter,
+			parts:    parts,
+			filled:   unmarshalled.Filled,
+			m_count:  unmarshalled.GetCount(),
 		}
 	}
 	panic("unhandled case")
@@ -285,13 +628,13 @@ func (r treeRef) read() tree {
 
 // all indirected methods
 
-func (r treeRef) persist(_ mdag.DAGService) treeRef {
+func (r treeRef) persist(_ store.BlockStore) treeRef {
 	// already persisted!
 	return r
 }
 
-func (r treeRef) insert(l leaf) tree {
-	return r.read().insert(l)
+func (r treeRef) insert(l leaf, policy InsertPolicy) tree {
+	return r.read().insert(l, policy)
 }
 
 func (r treeRef) remove(l leaf) (tree, bool) {
@@ -306,6 +649,30 @@ func (r treeRef) getFilter() filter.Filter {
 	return r.read().getFilter()
 }
 
+func (r treeRef) getParts() []filter.Filter {
+	return r.read().getParts()
+}
+
+func (r treeRef) getFilled() []string {
+	return r.read().getFilled()
+}
+
+func (r treeRef) count() uint64 {
+	if r.m_count != 0 {
+		return r.m_count
+	}
+	if r.cache == nil {
+		return r.read().count()
+	}
+
+	if entry, ok := r.cache.get(r.key); ok && entry.count != 0 {
+		return entry.count
+	}
+	count := r.read().count()
+	r.cache.keepCount(r.key, count)
+	return count
+}
+
 func (r treeRef) getLeavesDepth(i int) []int {
 	return r.read().getLeavesDepth(i)
 }
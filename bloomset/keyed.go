@@ -0,0 +1,89 @@
+package bloomset
+
+import (
+	proto "code.google.com/p/goprotobuf/proto"
+	"errors"
+	pb "github.com/krl/bloomtree/bloomset/pb"
+	"github.com/krl/bloomtree/filter"
+	. "github.com/krl/bloomtree/value"
+)
+
+var ErrNotEmpty = errors.New("set is not empty, rekey it instead")
+
+// WithKey returns the empty set keyed with k. Inserts and queries
+// then need filters keyed with k, and the info of k, but not k, is
+// persisted with the root.
+func (s BloomSet) WithKey(k *filter.Key) (BloomSet, error) {
+	if s.value != nil {
+		return s, ErrNotEmpty
+	}
+
+	info := k.Info()
+	keyed := s.with(nil)
+	keyed.key = &info
+	return keyed, nil
+}
+
+// KeyInfo returns what the set records about its key, or nil if it
+// isn't keyed
+func (s BloomSet) KeyInfo() *filter.KeyInfo {
+	return s.key
+}
+
+// Rekey rebuilds the set keyed with k, which rotates the key of a
+// keyed set or keys an unkeyed one. Every value is read back with
+// valfunc, which should give values filtered with k, and is kept as
+// the valfunc of the new set.
+func (s BloomSet) Rekey(k *filter.Key, valfunc func([]byte) Value) (BloomSet, error) {
+	rekeyed, _ := s.with(nil).WithKey(k)
+	rekeyed.valfunc = valfunc
+
+	if s.value == nil {
+		return rekeyed, nil
+	}
+
+	var err error
+	walk(s.value, 0, &Shape{}, func(l leaf) {
+		if err == nil {
+			rekeyed, err = rekeyed.TryInsert(valfunc(l.bytes))
+		}
+	})
+
+	if err != nil {
+		return s, err
+	}
+	return rekeyed, nil
+}
+
+func keyToMessage(info *filter.KeyInfo) *pb.KeyInfo {
+	if info == nil {
+		return nil
+	}
+
+	message := &pb.KeyInfo{
+		KDF:   proto.String(info.KDF),
+		Salt:  info.Salt,
+		Check: info.Check,
+	}
+	if info.ID != "" {
+		message.ID = proto.String(info.ID)
+	}
+	if info.Iterations > 0 {
+		message.Iterations = proto.Uint32(uint32(info.Iterations))
+	}
+	return message
+}
+
+func keyFromMessage(message *pb.Tree) *filter.KeyInfo {
+	if message.Key == nil {
+		return nil
+	}
+
+	return &filter.KeyInfo{
+		ID:         message.Key.GetID(),
+		KDF:        message.Key.GetKDF(),
+		Iterations: int(message.Key.GetIterations()),
+		Salt:       message.Key.GetSalt(),
+		Check:      message.Key.GetCheck(),
+	}
+}
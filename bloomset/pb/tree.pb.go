@@ -52,6 +52,10 @@ func (x *Tree_DataType) UnmarshalJSON(data []byte) error {
 type FilterElement struct {
 	Name             *string `protobuf:"bytes,1,req" json:"Name,omitempty"`
 	BloomFilter      []byte  `protobuf:"bytes,2,req" json:"BloomFilter,omitempty"`
+	Hashes           *uint32 `protobuf:"varint,3,opt" json:"Hashes,omitempty"`
+	Hashing          *uint32 `protobuf:"varint,4,opt" json:"Hashing,omitempty"`
+	Encoding         *uint32 `protobuf:"varint,5,opt" json:"Encoding,omitempty"`
+	Type             *uint32 `protobuf:"varint,6,opt" json:"Type,omitempty"`
 	XXX_unrecognized []byte  `json:"-"`
 }
 
@@ -73,10 +77,157 @@ func (m *FilterElement) GetBloomFilter() []byte {
 	return nil
 }
 
+func (m *FilterElement) GetHashes() uint32 {
+	if m != nil && m.Hashes != nil {
+		return *m.Hashes
+	}
+	return 0
+}
+
+func (m *FilterElement) GetHashing() uint32 {
+	if m != nil && m.Hashing != nil {
+		return *m.Hashing
+	}
+	return 0
+}
+
+func (m *FilterElement) GetEncoding() uint32 {
+	if m != nil && m.Encoding != nil {
+		return *m.Encoding
+	}
+	return 0
+}
+
+func (m *FilterElement) GetType() uint32 {
+	if m != nil && m.Type != nil {
+		return *m.Type
+	}
+	return 0
+}
+
+type FieldSpec struct {
+	Name             *string `protobuf:"bytes,1,req" json:"Name,omitempty"`
+	Bits             *uint32 `protobuf:"varint,2,req" json:"Bits,omitempty"`
+	Hashes           *uint32 `protobuf:"varint,3,req" json:"Hashes,omitempty"`
+	Hashing          *uint32 `protobuf:"varint,4,opt" json:"Hashing,omitempty"`
+	Type             *uint32 `protobuf:"varint,5,opt" json:"Type,omitempty"`
+	XXX_unrecognized []byte  `json:"-"`
+}
+
+func (m *FieldSpec) Reset()         { *m = FieldSpec{} }
+func (m *FieldSpec) String() string { return proto.CompactTextString(m) }
+func (*FieldSpec) ProtoMessage()    {}
+
+func (m *FieldSpec) GetName() string {
+	if m != nil && m.Name != nil {
+		return *m.Name
+	}
+	return ""
+}
+
+func (m *FieldSpec) GetBits() uint32 {
+	if m != nil && m.Bits != nil {
+		return *m.Bits
+	}
+	return 0
+}
+
+func (m *FieldSpec) GetHashes() uint32 {
+	if m != nil && m.Hashes != nil {
+		return *m.Hashes
+	}
+	return 0
+}
+
+func (m *FieldSpec) GetHashing() uint32 {
+	if m != nil && m.Hashing != nil {
+		return *m.Hashing
+	}
+	return 0
+}
+
+func (m *FieldSpec) GetType() uint32 {
+	if m != nil && m.Type != nil {
+		return *m.Type
+	}
+	return 0
+}
+
+type KeyInfo struct {
+	KDF              *string `protobuf:"bytes,1,req" json:"KDF,omitempty"`
+	Salt             []byte  `protobuf:"bytes,2,req" json:"Salt,omitempty"`
+	Check            []byte  `protobuf:"bytes,3,req" json:"Check,omitempty"`
+	ID               *string `protobuf:"bytes,4,opt" json:"ID,omitempty"`
+	Iterations       *uint32 `protobuf:"varint,5,opt" json:"Iterations,omitempty"`
+	XXX_unrecognized []byte  `json:"-"`
+}
+
+func (m *KeyInfo) Reset()         { *m = KeyInfo{} }
+func (m *KeyInfo) String() string { return proto.CompactTextString(m) }
+func (*KeyInfo) ProtoMessage()    {}
+
+func (m *KeyInfo) GetKDF() string {
+	if m != nil && m.KDF != nil {
+		return *m.KDF
+	}
+	return ""
+}
+
+func (m *KeyInfo) GetSalt() []byte {
+	if m != nil {
+		return m.Salt
+	}
+	return nil
+}
+
+func (m *KeyInfo) GetCheck() []byte {
+	if m != nil {
+		return m.Check
+	}
+	return nil
+}
+
+func (m *KeyInfo) GetID() string {
+	if m != nil && m.ID != nil {
+		return *m.ID
+	}
+	return ""
+}
+
+func (m *KeyInfo) GetIterations() uint32 {
+	if m != nil && m.Iterations != nil {
+		return *m.Iterations
+	}
+	return 0
+}
+
+type Part struct {
+	Filter           []*FilterElement `protobuf:"bytes,1,rep" json:"Filter,omitempty"`
+	XXX_unrecognized []byte           `json:"-"`
+}
+
+func (m *Part) Reset()         { *m = Part{} }
+func (m *Part) String() string { return proto.CompactTextString(m) }
+func (*Part) ProtoMessage()    {}
+
+func (m *Part) GetFilter() []*FilterElement {
+	if m != nil {
+		return m.Filter
+	}
+	return nil
+}
+
 type Tree struct {
 	Type             *Tree_DataType   `protobuf:"varint,1,req,enum=bloomset.pb.Tree_DataType" json:"Type,omitempty"`
 	Filter           []*FilterElement `protobuf:"bytes,2,rep" json:"Filter,omitempty"`
 	Data             []byte           `protobuf:"bytes,3,opt" json:"Data,omitempty"`
+	Count            *uint64          `protobuf:"varint,4,opt" json:"Count,omitempty"`
+	Schema           []*FieldSpec     `protobuf:"bytes,5,rep" json:"Schema,omitempty"`
+	Parts            []*Part          `protobuf:"bytes,6,rep" json:"Parts,omitempty"`
+	Key              *KeyInfo         `protobuf:"bytes,7,opt" json:"Key,omitempty"`
+	Links            [][]byte         `protobuf:"bytes,8,rep" json:"Links,omitempty"`
+	Filled           []string         `protobuf:"bytes,9,rep" json:"Filled,omitempty"`
+	Counts           []uint64         `protobuf:"varint,10,rep" json:"Counts,omitempty"`
 	XXX_unrecognized []byte           `json:"-"`
 }
 
@@ -105,6 +256,55 @@ func (m *Tree) GetData() []byte {
 	return nil
 }
 
+func (m *Tree) GetCount() uint64 {
+	if m != nil && m.Count != nil {
+		return *m.Count
+	}
+	return 0
+}
+
+func (m *Tree) GetSchema() []*FieldSpec {
+	if m != nil {
+		return m.Schema
+	}
+	return nil
+}
+
+func (m *Tree) GetParts() []*Part {
+	if m != nil {
+		return m.Parts
+	}
+	return nil
+}
+
+func (m *Tree) GetKey() *KeyInfo {
+	if m != nil {
+		return m.Key
+	}
+	return nil
+}
+
+func (m *Tree) GetLinks() [][]byte {
+	if m != nil {
+		return m.Links
+	}
+	return nil
+}
+
+func (m *Tree) GetFilled() []string {
+	if m != nil {
+		return m.Filled
+	}
+	return nil
+}
+
+func (m *Tree) GetCounts() []uint64 {
+	if m != nil {
+		return m.Counts
+	}
+	return nil
+}
+
 func init() {
 	proto.RegisterEnum("bloomset.pb.Tree_DataType", Tree_DataType_name, Tree_DataType_value)
 }
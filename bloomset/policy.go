@@ -0,0 +1,118 @@
+package bloomset
+
+import (
+	"github.com/krl/bloomtree/filter"
+	"math/rand"
+)
+
+// Branch describes one of the two children of a node
+type Branch struct {
+	Filter filter.Filter
+	Count  uint64
+}
+
+// An InsertPolicy routes a leaf being inserted to one of the two
+// children of a node, by returning 0 or 1
+type InsertPolicy interface {
+	Choose(children [2]Branch, leaf filter.Filter) int
+}
+
+// used to break ties, keeps the tree balanced
+func smaller(children [2]Branch) int {
+	if children[1].Count < children[0].Count {
+		return 1
+	}
+	return 0
+}
+
+// DistancePolicy picks the child with the lowest hamming distance to
+// the leaf. This is the default policy.
+type DistancePolicy struct{}
+
+func (DistancePolicy) Choose(children [2]Branch, leaf filter.Filter) int {
+
+	// if the inserted leaf lacks a specific filter
+	// this does not count towards the potential conflict
+
+	child0dist := children[0].Filter.HammingDistance(leaf)
+	child1dist := children[1].Filter.HammingDistance(leaf)
+
+	if child0dist == child1dist {
+		return child0dist % 2
+	} else if child0dist < child1dist {
+		return 0
+	}
+	return 1
+}
+
+// BalancePolicy picks the child with the fewest leaves, falling back
+// to the hamming distance when they are equal
+type BalancePolicy struct{}
+
+func (BalancePolicy) Choose(children [2]Branch, leaf filter.Filter) int {
+	if children[0].Count == children[1].Count {
+		return DistancePolicy{}.Choose(children, leaf)
+	}
+	return smaller(children)
+}
+
+// GrowthPolicy picks the child whose filter gains the fewest set bits
+// when merged with the leaf
+type GrowthPolicy struct{}
+
+func (GrowthPolicy) Choose(children [2]Branch, leaf filter.Filter) int {
+	growth := [2]int{}
+
+	for i := 0; i < 2; i++ {
+		growth[i] = children[i].Filter.Merge(leaf).Popcount() -
+			children[i].Filter.Popcount()
+	}
+
+	if growth[0] == growth[1] {
+		return smaller(children)
+	} else if growth[0] < growth[1] {
+		return 0
+	}
+	return 1
+}
+
+// WeightedPolicy picks the child with the lowest weighted distance to
+// the leaf, see filter.WeightedDistance. Use it to make the fields
+// that are queried on decide the clustering.
+type WeightedPolicy struct {
+	Weights filter.Weights
+}
+
+func (p WeightedPolicy) Choose(children [2]Branch, leaf filter.Filter) int {
+	child0dist := children[0].Filter.WeightedDistance(leaf, p.Weights)
+	child1dist := children[1].Filter.WeightedDistance(leaf, p.Weights)
+
+	if child0dist == child1dist {
+		return smaller(children)
+	} else if child0dist < child1dist {
+		return 0
+	}
+	return 1
+}
+
+// RandomPolicy picks a child at random, with the odds weighted
+// towards the smaller child to keep the tree balanced
+type RandomPolicy struct {
+	Rand *rand.Rand // uses the global source if nil
+}
+
+func (p RandomPolicy) Choose(children [2]Branch, leaf filter.Filter) int {
+	total := int64(children[0].Count + children[1].Count)
+
+	var pick int64
+	if p.Rand != nil {
+		pick = p.Rand.Int63n(total)
+	} else {
+		pick = rand.Int63n(total)
+	}
+
+	if pick < int64(children[1].Count) {
+		return 0
+	}
+	return 1
+}
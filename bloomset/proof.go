@@ -0,0 +1,122 @@
+package bloomset
+
+import (
+	proto "code.google.com/p/goprotobuf/proto"
+	"errors"
+	"fmt"
+	pb "github.com/krl/bloomtree/bloomset/pb"
+	"github.com/krl/bloomtree/filter"
+	"github.com/krl/bloomtree/store"
+	. "github.com/krl/bloomtree/value"
+)
+
+// FindProof shows that the result of a query is complete. It holds
+// the blocks on the paths to every returned leaf, and the blocks of
+// the pruned subtrees, whose filters do not match the query.
+type FindProof struct {
+	Blocks [][]byte
+}
+
+var ErrNotPersisted = errors.New("set is not persisted")
+
+// provenFind visits the blocks a query needs, the same way for
+// creating and for verifying a proof, and returns the data of the
+// leaves reached
+func provenFind(get func(store.Key) ([]byte, error), root store.Key, f filter.Filter) ([][]byte, error) {
+	results := [][]byte{}
+
+	var visit func(key store.Key) error
+	visit = func(key store.Key) error {
+		block, err := get(key)
+		if err != nil {
+			return err
+		}
+
+		message := new(pb.Tree)
+		err = proto.Unmarshal(block, message)
+		if err != nil {
+			return err
+		}
+
+		parts, err := partsFromMessage(message)
+		if err != nil {
+			return err
+		}
+		if !mayContain(parts, f) {
+			// pruned
+			return nil
+		}
+
+		switch message.GetType() {
+		case pb.Tree_Leaf:
+			results = append(results, message.Data)
+		case pb.Tree_Node:
+			if len(message.Links) != 2 {
+				return errors.New("node without 2 links")
+			}
+			for _, link := range message.Links {
+				err = visit(store.Key(link))
+				if err != nil {
+					return err
+				}
+			}
+		default:
+			return fmt.Errorf("unknown block type %v", message.GetType())
+		}
+		return nil
+	}
+
+	err := visit(root)
+	return results, err
+}
+
+// FindWithProof returns the values matching the filter, with a proof
+// that VerifyFind can check against the root key of the set
+func (s BloomSet) FindWithProof(f filter.Filter) ([]Value, FindProof, error) {
+	ref, ok := s.value.(treeRef)
+	if !ok {
+		return nil, FindProof{}, ErrNotPersisted
+	}
+
+	proof := FindProof{}
+
+	get := func(key store.Key) ([]byte, error) {
+		block, err := ref.store.Get(key)
+		if err == nil {
+			proof.Blocks = append(proof.Blocks, block)
+		}
+		return block, err
+	}
+
+	results, err := provenFind(get, ref.key, f)
+	if err != nil {
+		return nil, FindProof{}, err
+	}
+
+	values := make([]Value, len(results))
+	for i, bytes := range results {
+		values[i] = s.valfunc(bytes)
+	}
+	return values, proof, nil
+}
+
+// VerifyFind checks that a proof from FindWithProof holds every block
+// needed to run the query on the set with the given root key, and
+// returns the serialized values the query matches
+func VerifyFind(root store.Key, f filter.Filter, proof FindProof) ([][]byte, error) {
+	blocks := map[store.Key][]byte{}
+
+	for _, block := range proof.Blocks {
+		blocks[store.Hash(block)] = block
+	}
+
+	get := func(key store.Key) ([]byte, error) {
+		block, ok := blocks[key]
+		if !ok {
+			return nil, fmt.Errorf("proof is missing block %v", key)
+		}
+		return block, nil
+	}
+
+	return provenFind(get, root, f)
+}
@@ -0,0 +1,113 @@
+package bloomset
+
+import (
+	"github.com/krl/bloomtree/filter"
+	"github.com/krl/bloomtree/store"
+	"sort"
+)
+
+// Shape is a summary of the structure of a set
+type Shape struct {
+	Depth         int
+	Blocks        int
+	AvgFilterFill float64
+}
+
+type RepackReport struct {
+	Before Shape
+	After  Shape
+}
+
+// walk visits every node of the tree, loading referenced nodes as
+// needed, records the shape and hands each leaf to fn
+func walk(t tree, depth int, shape *Shape, fn func(leaf)) {
+	switch n := t.(type) {
+	case treeRef:
+		walk(n.read(), depth, shape, fn)
+		return
+	case node:
+		for _, c := range n.children {
+			walk(c, depth+1, shape, fn)
+		}
+	case leaf:
+		if depth > shape.Depth {
+			shape.Depth = depth
+		}
+		fn(n)
+	}
+
+	// running average over all blocks
+	shape.Blocks++
+	fill := t.getFilter().Fill()
+	shape.AvgFilterFill += (fill - shape.AvgFilterFill) / float64(shape.Blocks)
+}
+
+type byPull struct {
+	leaves []leaf
+	pull   []int
+}
+
+func (b byPull) Len() int           { return len(b.leaves) }
+func (b byPull) Less(i, j int) bool { return b.pull[i] < b.pull[j] }
+func (b byPull) Swap(i, j int) {
+	b.leaves[i], b.leaves[j] = b.leaves[j], b.leaves[i]
+	b.pull[i], b.pull[j] = b.pull[j], b.pull[i]
+}
+
+// pack builds a tree of minimal depth by recursively splitting the
+// leaves in two equally sized halves, one clustered around the first
+// leaf and the other around the leaf furthest away from it
+func pack(leaves []leaf) tree {
+	if len(leaves) == 1 {
+		return leaves[0]
+	}
+
+	var a, b filter.Filter = leaves[0].filter, leaves[0].filter
+	furthest := -1
+
+	for _, l := range leaves {
+		if dist := a.HammingDistance(l.filter); dist > furthest {
+			furthest = dist
+			b = l.filter
+		}
+	}
+
+	pull := make([]int, len(leaves))
+	for i, l := range leaves {
+		pull[i] = a.HammingDistance(l.filter) - b.HammingDistance(l.filter)
+	}
+
+	sort.Sort(byPull{leaves: leaves, pull: pull})
+
+	half := len(leaves) / 2
+	return newNode(pack(leaves[:half]), pack(leaves[half:]))
+}
+
+// Repack streams every leaf out of the set and writes a replacement
+// tree of minimal depth, with similar leaves clustered, to st
+func (s BloomSet) Repack(st store.BlockStore) (BloomSet, RepackReport) {
+	report := RepackReport{}
+
+	if s.value == nil {
+		return s, report
+	}
+
+	stream := make(chan leaf)
+
+	go func() {
+		walk(s.value, 0, &report.Before, func(l leaf) {
+			stream <- l
+		})
+		close(stream)
+	}()
+
+	leaves := []leaf{}
+	for l := range stream {
+		leaves = append(leaves, l)
+	}
+
+	packed := pack(leaves)
+	walk(packed, 0, &report.After, func(leaf) {})
+
+	return s.with(persistRoot(packed, st, s.schema, s.key)), report
+}
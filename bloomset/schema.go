@@ -0,0 +1,190 @@
+package bloomset
+
+import (
+	proto "code.google.com/p/goprotobuf/proto"
+	pb "github.com/krl/bloomtree/bloomset/pb"
+	"github.com/krl/bloomtree/filter"
+	"github.com/krl/bloomtree/store"
+	. "github.com/krl/bloomtree/value"
+)
+
+// WithSchema returns the set with a schema that inserts and queries
+// are checked against. The schema is persisted with the root.
+func (s BloomSet) WithSchema(schema filter.Schema) (BloomSet, error) {
+	err := schema.Check()
+	if err != nil {
+		return s, err
+	}
+
+	checked := s.with(s.value)
+	checked.schema = schema
+	return checked, nil
+}
+
+// Schema returns the schema of the set, or nil if it has none
+func (s BloomSet) Schema() filter.Schema {
+	return s.schema
+}
+
+// validateValue checks the filter of a value against the schema and
+// the key of the set, and that it merges with the filters already in
+// it, which sets without a schema have to check
+func (s BloomSet) validateValue(f filter.Filter) error {
+	if s.schema != nil {
+		err := s.schema.ValidateValue(f)
+		if err != nil {
+			return err
+		}
+	}
+	if s.key != nil {
+		err := s.key.Validate(f)
+		if err != nil {
+			return err
+		}
+	}
+	if s.value != nil {
+		return s.value.getFilter().Matches(f)
+	}
+	return nil
+}
+
+func (s BloomSet) validateQuery(f filter.Filter) error {
+	if s.schema != nil {
+		err := s.schema.ValidateQuery(f)
+		if err != nil {
+			return err
+		}
+	}
+	if s.key != nil {
+		return s.key.Validate(f)
+	}
+	return nil
+}
+
+func (s BloomSet) TryInsert(v Value) (BloomSet, error) {
+	err := s.validateValue(v.GetFilter())
+	if err != nil {
+		return s, err
+	}
+	return s.insert(v), nil
+}
+
+func (s BloomSet) TryRemove(v Value) (BloomSet, error) {
+	err := s.validateValue(v.GetFilter())
+	if err != nil {
+		return s, err
+	}
+	return s.Remove(v), nil
+}
+
+func (s *BloomSet) TryFind(f filter.Filter) (<-chan Value, error) {
+	err := s.validateQuery(f)
+	if err != nil {
+		return nil, err
+	}
+	return s.Find(f), nil
+}
+
+func schemaToMessage(schema filter.Schema) []*pb.FieldSpec {
+	specs := make([]*pb.FieldSpec, len(schema))
+	for i, f := range schema {
+		specs[i] = &pb.FieldSpec{
+			Name:   proto.String(f.Name),
+			Bits:   proto.Uint32(uint32(f.Bits)),
+			Hashes: proto.Uint32(uint32(f.Hashes)),
+		}
+		if f.Hashing != filter.Legacy {
+			specs[i].Hashing = proto.Uint32(uint32(f.Hashing))
+		}
+		if f.Type != filter.BloomType {
+			specs[i].Type = proto.Uint32(uint32(f.Type))
+		}
+	}
+	return specs
+}
+
+func schemaFromMessage(message *pb.Tree) filter.Schema {
+	if len(message.Schema) == 0 {
+		return nil
+	}
+
+	schema := make(filter.Schema, len(message.Schema))
+	for i, spec := range message.Schema {
+		schema[i] = filter.Field{
+			Name:    spec.GetName(),
+			Type:    filter.Type(spec.GetType()),
+			Bits:    int(spec.GetBits()),
+			Hashes:  int(spec.GetHashes()),
+			Hashing: filter.Hashing(spec.GetHashing()),
+		}
+	}
+	return schema
+}
+
+// readRoot returns the schema and key persisted with a root, or nil
+// if there are none or the root can't be read, which is left to fail
+// later
+func readRoot(st store.BlockStore, root store.Key) (filter.Schema, *filter.KeyInfo) {
+	block, err := st.Get(root)
+	if err != nil {
+		return nil, nil
+	}
+
+	message := new(pb.Tree)
+	err = proto.Unmarshal(block, message)
+	if err != nil {
+		return nil, nil
+	}
+	return schemaFromMessage(message), keyFromMessage(message)
+}
+
+// persistRoot writes the tree with the schema and key in its root
+// block, which is only rewritten if the tree is already persisted
+func persistRoot(t tree, st store.BlockStore, schema filter.Schema, info *filter.KeyInfo) treeRef {
+	if schema == nil && info == nil {
+		return t.persist(st)
+	}
+
+	if r, ok := t.(treeRef); ok {
+		return r.withRoot(schema, info)
+	}
+
+	message := messageFromTree(t, st)
+	message.Schema = schemaToMessage(schema)
+	message.Key = keyToMessage(info)
+	return putMessage(message, st)
+}
+
+// withRoot rewrites the block of a root to hold the schema and key
+func (r treeRef) withRoot(schema filter.Schema, info *filter.KeyInfo) treeRef {
+	block, err := r.store.Get(r.key)
+	if err != nil {
+		panic(err)
+	}
+
+	message := new(pb.Tree)
+	err = proto.Unmarshal(block, message)
+	if err != nil {
+		panic(err)
+	}
+
+	message.Schema = schemaToMessage(schema)
+	message.Key = keyToMessage(info)
+	return putMessage(message, r.store)
+}
+
+// asChild returns a tree that can be the child of a node. The root of
+// a persisted set may hold its schema and key, so it is loaded, to be
+// written again without them.
+func asChild(t tree) tree {
+	r, ok := t.(treeRef)
+	if !ok {
+		return t
+	}
+
+	schema, info := readRoot(r.store, r.key)
+	if schema == nil && info == nil {
+		return r
+	}
+	return r.read()
+}
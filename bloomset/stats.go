@@ -0,0 +1,156 @@
+package bloomset
+
+import (
+	proto "code.google.com/p/goprotobuf/proto"
+	pb "github.com/krl/bloomtree/bloomset/pb"
+	"github.com/krl/bloomtree/filter"
+	"github.com/krl/bloomtree/store"
+)
+
+// Stats describe the structure of a set. Nodes held in memory or in
+// the cache are loaded, other treeRefs are not. Block sizes are only
+// known for nodes read from the store.
+type Stats struct {
+	// leaves at every depth, the root is at depth 0
+	LeafDepths []int
+
+	// nodes by type: node and leaf
+	Nodes map[string]int
+
+	Loaded   int
+	Unloaded int
+
+	Blocks     int
+	BlockBytes int
+
+	// average ratio of set bits in every filter field, for each depth,
+	// over the nodes at that depth that have the field
+	Saturation []map[string]float64
+
+	// nodes with each field at every depth, for the averages
+	fields []map[string]int
+}
+
+func (s Stats) Leaves() int {
+	leaves := 0
+	for _, n := range s.LeafDepths {
+		leaves += n
+	}
+	return leaves
+}
+
+func (s Stats) AvgBlockSize() float64 {
+	if s.Blocks == 0 {
+		return 0
+	}
+	return float64(s.BlockBytes) / float64(s.Blocks)
+}
+
+func (s *Stats) addLeaf(depth int) {
+	for len(s.LeafDepths) <= depth {
+		s.LeafDepths = append(s.LeafDepths, 0)
+	}
+	s.LeafDepths[depth]++
+}
+
+// addFilter keeps a running average of the fill of every field
+func (s *Stats) addFilter(f filter.Filter, depth int) {
+	for len(s.Saturation) <= depth {
+		s.Saturation = append(s.Saturation, map[string]float64{})
+		s.fields = append(s.fields, map[string]int{})
+	}
+
+	level, fields := s.Saturation[depth], s.fields[depth]
+
+	for name, ratio := range fill(f) {
+		fields[name]++
+		level[name] += (ratio - level[name]) / float64(fields[name])
+	}
+}
+
+func (s *Stats) add(t tree, depth int, stopAtUnloaded bool) error {
+	var children []tree
+
+	switch n := t.(type) {
+	case node:
+		s.Loaded++
+		s.Nodes["node"]++
+		s.addFilter(n.filter, depth)
+		children = n.children[:]
+	case leaf:
+		s.Loaded++
+		s.Nodes["leaf"]++
+		s.addFilter(n.filter, depth)
+		s.addLeaf(depth)
+	case treeRef:
+		if cached, ok := n.cached(); ok {
+			return s.add(cached, depth, stopAtUnloaded)
+		}
+
+		s.Unloaded++
+		if stopAtUnloaded {
+			return nil
+		}
+
+		block, err := n.store.Get(n.key)
+		if err != nil {
+			return err
+		}
+		message := new(pb.Tree)
+		err = proto.Unmarshal(block, message)
+		if err != nil {
+			return err
+		}
+
+		s.Blocks++
+		s.BlockBytes += len(block)
+		f, err := filterFromMessage(message)
+		if err != nil {
+			return err
+		}
+		s.addFilter(f, depth)
+
+		switch message.GetType() {
+		case pb.Tree_Leaf:
+			s.Nodes["leaf"]++
+			s.addLeaf(depth)
+		case pb.Tree_Node:
+			s.Nodes["node"]++
+		}
+
+		if message.GetType() == pb.Tree_Node {
+			links, err := store.TreeLinks(n.store, n.key, message.Links)
+			if err != nil {
+				return err
+			}
+			for _, link := range links {
+				children = append(children, n.ref(link))
+			}
+		}
+	}
+
+	for _, c := range children {
+		err := s.add(c, depth+1, stopAtUnloaded)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Stats walks the set and describes its structure. With
+// stopAtUnloaded, no blocks are read, and nothing below a treeRef is
+// counted.
+func (s BloomSet) Stats(stopAtUnloaded bool) (Stats, error) {
+	stats := Stats{
+		LeafDepths: []int{},
+		Nodes:      map[string]int{},
+	}
+
+	if s.value == nil {
+		return stats, nil
+	}
+
+	err := stats.add(s.value, 0, stopAtUnloaded)
+	return stats, err
+}
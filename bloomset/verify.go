@@ -0,0 +1,225 @@
+package bloomset
+
+import (
+	proto "code.google.com/p/goprotobuf/proto"
+	"fmt"
+	pb "github.com/krl/bloomtree/bloomset/pb"
+	"github.com/krl/bloomtree/filter"
+	"github.com/krl/bloomtree/store"
+)
+
+// Violation is a problem with one block of a persisted set
+type Violation struct {
+	Key     store.Key
+	Problem string
+}
+
+func (v Violation) String() string {
+	return fmt.Sprintf("%v: %v", v.Key, v.Problem)
+}
+
+// Report lists the problems Verify found in the blocks it checked
+type Report struct {
+	Blocks     int
+	Violations []Violation
+}
+
+func (r Report) OK() bool {
+	return len(r.Violations) == 0
+}
+
+// what a verified subtree looks like to its parent
+type checked struct {
+	valid  bool
+	count  uint64
+	filter filter.Filter
+	parts  []filter.Filter
+	filled []string
+}
+
+type verifier struct {
+	store  store.BlockStore
+	report Report
+	seen   map[store.Key]checked
+}
+
+func (v *verifier) fail(key store.Key, problem string, args ...interface{}) {
+	v.report.Violations = append(v.report.Violations, Violation{
+		Key:     key,
+		Problem: fmt.Sprintf(problem, args...),
+	})
+}
+
+// uncovered returns the fields of the child filter that have bits set
+// which the parent filter doesn't
+func uncovered(parent, child filter.Filter) []string {
+	fields := []string{}
+
+	for k := range child {
+		if parent[k] == nil {
+			fields = append(fields, k)
+			continue
+		}
+
+		// filters of another type, size or hashing can't be covered
+		covered, err := parent[k].Superset(child[k])
+		if err != nil || !covered {
+			fields = append(fields, k)
+		}
+	}
+	return fields
+}
+
+func coveredByAny(parts []filter.Filter, f filter.Filter) bool {
+	for _, p := range parts {
+		if len(uncovered(p, f)) == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (v *verifier) check(key store.Key) checked {
+	if c, ok := v.seen[key]; ok {
+		return c
+	}
+
+	c := v.checkBlock(key)
+	v.seen[key] = c
+	return c
+}
+
+func (v *verifier) checkBlock(key store.Key) checked {
+	block, err := v.store.Get(key)
+	if err != nil {
+		v.fail(key, "can't read block: %v", err)
+		return checked{}
+	}
+	v.report.Blocks++
+
+	message := new(pb.Tree)
+	err = proto.Unmarshal(block, message)
+	if err != nil || message.Type == nil {
+		v.fail(key, "can't decode block")
+		return checked{}
+	}
+
+	names := map[string]bool{}
+	for _, element := range message.Filter {
+		if names[element.GetName()] {
+			v.fail(key, "filter field %q appears twice", element.GetName())
+			return checked{}
+		}
+		names[element.GetName()] = true
+	}
+
+	filter, err := filterFromMessage(message)
+	if err != nil {
+		v.fail(key, "can't decode filter: %v", err)
+		return checked{}
+	}
+	parts, err := partsFromMessage(message)
+	if err != nil {
+		v.fail(key, "can't decode filter parts: %v", err)
+		return checked{}
+	}
+
+	links := []store.Key{}
+	if message.GetType() == pb.Tree_Node || len(message.Links) > 0 {
+		links, err = store.TreeLinks(v.store, key, message.Links)
+		if err != nil {
+			v.fail(key, "can't read links: %v", err)
+			return checked{}
+		}
+	}
+
+	// the key of a legacy block hashes links with sizes the block
+	// doesn't hold, the DAG store checks it instead
+	legacy := len(message.Links) == 0 && len(links) > 0
+	if !legacy && store.Hash(block) != key {
+		v.fail(key, "block does not match its key")
+	}
+
+	switch message.GetType() {
+	case pb.Tree_Leaf:
+		if len(links) != 0 {
+			v.fail(key, "leaf with %v links", len(links))
+			return checked{}
+		}
+		if message.Count != nil && message.GetCount() != 1 {
+			v.fail(key, "leaf with count %v", message.GetCount())
+		}
+		return checked{valid: true, count: 1, filter: filter, parts: parts, filled: filter.Filled()}
+
+	case pb.Tree_Node:
+		if len(links) != 2 {
+			v.fail(key, "node with %v links", len(links))
+			return checked{}
+		}
+
+	default:
+		v.fail(key, "unknown block type %v", message.GetType())
+		return checked{}
+	}
+
+	// every child is checked, but problems further down are reported
+	// there, and not again here
+	children := make([]checked, len(links))
+	valid := true
+	for i, link := range links {
+		children[i] = v.check(link)
+		valid = valid && children[i].valid
+	}
+	if !valid {
+		return checked{}
+	}
+
+	var count uint64
+	for i, child := range children {
+		link := links[i]
+		count += child.count
+
+		// nodes written before child counts were stored have none
+		if counts := message.Counts; len(counts) != 0 && (len(counts) != 2 || counts[i] != child.count) {
+			v.fail(key, "child %v is counted %v, but holds %v", link, counts, child.count)
+		}
+
+		for _, field := range uncovered(filter, child.filter) {
+			v.fail(key, "filter field %q does not cover child %v", field, link)
+		}
+
+		if missing := len(message.Filled) - len(both(message.Filled, child.filled)); missing > 0 {
+			v.fail(key, "%v filled fields are empty in child %v", missing, link)
+		}
+
+		// without parts, the filter check is enough
+		for i, part := range child.parts {
+			if len(message.Parts) > 0 && !coveredByAny(parts, part) {
+				v.fail(key, "no part covers part %v of child %v", i, link)
+			}
+		}
+	}
+
+	// blocks written before counts were stored have none
+	if message.Count != nil && message.GetCount() != count {
+		v.fail(key, "count is %v, children hold %v", message.GetCount(), count)
+	}
+
+	return checked{valid: true, count: count, filter: filter, parts: parts, filled: message.Filled}
+}
+
+// Verify checks every block of the set persisted with the given root
+// key: that it can be read and decoded, that it matches its key, that
+// counts add up, and that the filter of every node covers the filters
+// of its children, and its parts the parts of its children. The fields
+// a node lists as filled must be filled in its children, and the
+// counts it records for them must be theirs.
+func Verify(s store.BlockStore, root store.Key) Report {
+	v := &verifier{
+		store: s,
+		seen:  map[store.Key]checked{},
+	}
+
+	v.check(root)
+	return v.report
+}
@@ -0,0 +1,510 @@
+// Command bloomtree inspects and edits trees persisted in a single-file
+// block store.
+//
+//	bloomtree [-store file] seq insert <root> <index> <value>...
+//	bloomtree [-store file] seq get <root> <index>
+//	bloomtree [-store file] seq remove <root> <index>
+//	bloomtree [-store file] seq len <root>
+//	bloomtree [-store file] seq dump <root>
+//	bloomtree [-store file] set insert <root> <value>...
+//	bloomtree [-store file] set find <root> <word>...
+//	bloomtree [-store file] set remove <root> <value>...
+//	bloomtree [-store file] set dump <root>
+//	bloomtree [-store file] verify <seq|set> <root>
+//	bloomtree [-store file] stats <seq|set> <root>
+//	bloomtree [-store file] export <seq|set> <root> <file>
+//	bloomtree [-store file] import <file>
+//
+// Roots are hex keys, "empty" is the root of an empty tree. A value
+// given as @name is read from the file name, and one value given as -
+// is read from stdin, as are archives given as -. Set values are text, indexed by word and
+// word count. Commands that change a tree print its new root.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/krl/bloomtree/bloomseq"
+	"github.com/krl/bloomtree/bloomset"
+	"github.com/krl/bloomtree/common"
+	"github.com/krl/bloomtree/filter"
+	"github.com/krl/bloomtree/store"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const emptyRoot = "empty"
+
+var errUsage = errors.New("usage: bloomtree [-store file] <seq|set|verify|stats|export|import> ...")
+
+func main() {
+	path := flag.String("store", "bloomtree.blocks", "block file to use")
+	flag.Parse()
+
+	st, err := store.OpenFileStore(*path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	err = run(st, flag.Args(), os.Stdout)
+
+	if cerr := st.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func run(st *store.FileStore, args []string, out io.Writer) error {
+	if len(args) < 1 {
+		return errUsage
+	}
+
+	switch args[0] {
+	case "seq":
+		return seqCommand(st, args[1:], out)
+	case "set":
+		return setCommand(st, args[1:], out)
+	case "verify":
+		return verifyCommand(st, args[1:], out)
+	case "stats":
+		return statsCommand(st, args[1:], out)
+	case "export":
+		return exportCommand(st, args[1:])
+	case "import":
+		return importCommand(st, args[1:], out)
+	}
+	return errUsage
+}
+
+// arguments
+
+func parseRoot(s string) (store.Key, error) {
+	if s == emptyRoot {
+		return "", nil
+	}
+	return store.ParseKey(s)
+}
+
+func printRoot(out io.Writer, root store.Key) {
+	if root == "" {
+		fmt.Fprintln(out, emptyRoot)
+		return
+	}
+	fmt.Fprintln(out, root)
+}
+
+func parseIndex(s string) (uint64, error) {
+	return strconv.ParseUint(s, 10, 64)
+}
+
+var stdin io.Reader = os.Stdin
+
+// readValue returns the argument, or the contents of the file or stdin
+// it names
+func readValue(arg string) ([]byte, error) {
+	switch {
+	case arg == "-":
+		return ioutil.ReadAll(stdin)
+	case strings.HasPrefix(arg, "@"):
+		return ioutil.ReadFile(arg[1:])
+	}
+	return []byte(arg), nil
+}
+
+// readValues reads every value argument, of which only one can be
+// read from stdin
+func readValues(args []string) ([][]byte, error) {
+	fromStdin := 0
+	for _, arg := range args {
+		if arg == "-" {
+			fromStdin++
+		}
+	}
+	if fromStdin > 1 {
+		return nil, errors.New("only one value can be read from stdin")
+	}
+
+	values := make([][]byte, len(args))
+	for i, arg := range args {
+		value, err := readValue(arg)
+		if err != nil {
+			return nil, err
+		}
+		values[i] = value
+	}
+	return values, nil
+}
+
+func openInput(arg string) (io.ReadCloser, error) {
+	if arg == "-" {
+		return ioutil.NopCloser(stdin), nil
+	}
+	return os.Open(arg)
+}
+
+// parseStoredRoot parses a root, which must be in the store unless it
+// is the empty root
+func parseStoredRoot(st store.BlockStore, arg string) (store.Key, error) {
+	root, err := parseRoot(arg)
+	if err != nil || root == "" {
+		return root, err
+	}
+
+	ok, err := store.Has(st, root)
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		return "", fmt.Errorf("no tree with root %v in the store", root)
+	}
+	return root, nil
+}
+
+func loadSeq(st store.BlockStore, arg string) (bloomseq.BloomSeq, error) {
+	root, err := parseStoredRoot(st, arg)
+	if err != nil || root == "" {
+		return bloomseq.BloomSeq{}, err
+	}
+	return bloomseq.Load(st, root), nil
+}
+
+func loadSet(st store.BlockStore, arg string) (bloomset.BloomSet, error) {
+	set := bloomset.NewBloomSet(common.DeserializeTextValue, nil)
+
+	root, err := parseStoredRoot(st, arg)
+	if err != nil || root == "" {
+		return set, err
+	}
+	return set.Load(st, root), nil
+}
+
+// sequences
+
+func seqCommand(st store.BlockStore, args []string, out io.Writer) error {
+	if len(args) < 2 {
+		return errUsage
+	}
+
+	seq, err := loadSeq(st, args[1])
+	if err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "insert":
+		if len(args) < 4 {
+			return errUsage
+		}
+		i, err := parseIndex(args[2])
+		if err != nil {
+			return err
+		}
+		if i > seq.Count() {
+			return fmt.Errorf("index %v out of range", i)
+		}
+		values, err := readValues(args[3:])
+		if err != nil {
+			return err
+		}
+		for _, value := range values {
+			seq = seq.InsertAt(i, value)
+			i++
+		}
+		printRoot(out, seq.Persist(st).Root())
+
+	case "get":
+		if len(args) != 3 {
+			return errUsage
+		}
+		i, err := parseIndex(args[2])
+		if err != nil {
+			return err
+		}
+		if i >= seq.Count() {
+			return fmt.Errorf("index %v out of range", i)
+		}
+		value, err := seq.GetAt(i)
+		if err != nil {
+			return err
+		}
+		out.Write(value)
+		fmt.Fprintln(out)
+
+	case "remove":
+		if len(args) != 3 {
+			return errUsage
+		}
+		i, err := parseIndex(args[2])
+		if err != nil {
+			return err
+		}
+		if i >= seq.Count() {
+			return fmt.Errorf("index %v out of range", i)
+		}
+		printRoot(out, seq.RemoveAt(i).Persist(st).Root())
+
+	case "len":
+		fmt.Fprintln(out, seq.Count())
+
+	case "dump":
+		var i uint64
+		for i = 0; i < seq.Count(); i++ {
+			value, err := seq.GetAt(i)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(out, "%v\t%s\n", i, value)
+		}
+
+	default:
+		return errUsage
+	}
+	return nil
+}
+
+// sets
+
+func setCommand(st store.BlockStore, args []string, out io.Writer) error {
+	if len(args) < 2 {
+		return errUsage
+	}
+
+	set, err := loadSet(st, args[1])
+	if err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "insert", "remove":
+		if len(args) < 3 {
+			return errUsage
+		}
+		values, err := readValues(args[2:])
+		if err != nil {
+			return err
+		}
+		for _, value := range values {
+			v := common.NewTextValue(string(value))
+			if args[0] == "insert" {
+				set, err = set.TryInsert(v)
+			} else {
+				set, err = set.TryRemove(v)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		printRoot(out, set.Persist(st).Root())
+
+	case "find":
+		if len(args) < 3 {
+			return errUsage
+		}
+		query := filter.EmptyFilter()
+		for _, word := range args[2:] {
+			query = query.Merge(common.TextFilter(word))
+		}
+		printValues(&set, query, out)
+
+	case "dump":
+		if len(args) != 2 {
+			return errUsage
+		}
+		// the empty filter matches everything
+		printValues(&set, filter.EmptyFilter(), out)
+
+	default:
+		return errUsage
+	}
+	return nil
+}
+
+func printValues(set *bloomset.BloomSet, query filter.Filter, out io.Writer) {
+	for v := range set.Find(query) {
+		fmt.Fprintln(out, v.(common.TextValue).Content)
+	}
+}
+
+// whole trees
+
+func verifyCommand(st store.BlockStore, args []string, out io.Writer) error {
+	if len(args) != 2 || args[0] != "seq" && args[0] != "set" {
+		return errUsage
+	}
+
+	root, err := parseRoot(args[1])
+	if err != nil {
+		return err
+	}
+	if root == "" {
+		fmt.Fprintln(out, "0 blocks checked, the tree is empty")
+		return nil
+	}
+
+	var violations []fmt.Stringer
+
+	switch args[0] {
+	case "seq":
+		report := bloomseq.Verify(st, root)
+		fmt.Fprintf(out, "%v blocks checked\n", report.Blocks)
+		for _, v := range report.Violations {
+			violations = append(violations, v)
+		}
+	case "set":
+		report := bloomset.Verify(st, root)
+		fmt.Fprintf(out, "%v blocks checked\n", report.Blocks)
+		for _, v := range report.Violations {
+			violations = append(violations, v)
+		}
+	default:
+		return errUsage
+	}
+
+	for _, v := range violations {
+		fmt.Fprintln(out, v)
+	}
+	if len(violations) > 0 {
+		return fmt.Errorf("%v violations", len(violations))
+	}
+	return nil
+}
+
+func statsCommand(st store.BlockStore, args []string, out io.Writer) error {
+	if len(args) != 2 {
+		return errUsage
+	}
+
+	var leafDepths []int
+	var nodes map[string]int
+	var blocks, size int
+	var avg float64
+	var saturation []map[string]float64
+
+	switch args[0] {
+	case "seq":
+		seq, err := loadSeq(st, args[1])
+		if err != nil {
+			return err
+		}
+		stats, err := seq.Stats(false)
+		if err != nil {
+			return err
+		}
+		leafDepths, nodes = stats.LeafDepths, stats.Nodes
+		blocks, size, avg = stats.Blocks, stats.BlockBytes, stats.AvgBlockSize()
+	case "set":
+		set, err := loadSet(st, args[1])
+		if err != nil {
+			return err
+		}
+		stats, err := set.Stats(false)
+		if err != nil {
+			return err
+		}
+		leafDepths, nodes = stats.LeafDepths, stats.Nodes
+		blocks, size, avg = stats.Blocks, stats.BlockBytes, stats.AvgBlockSize()
+		saturation = stats.Saturation
+	default:
+		return errUsage
+	}
+
+	fmt.Fprintf(out, "blocks read\t%v\n", blocks)
+	fmt.Fprintf(out, "bytes read\t%v\n", size)
+	fmt.Fprintf(out, "average block size\t%.1f\n", avg)
+
+	for _, name := range sortedKeys(nodes) {
+		fmt.Fprintf(out, "%v blocks\t%v\n", name, nodes[name])
+	}
+
+	for depth, leaves := range leafDepths {
+		if leaves > 0 {
+			fmt.Fprintf(out, "leaves at depth %v\t%v\n", depth, leaves)
+		}
+	}
+
+	for depth, level := range saturation {
+		for _, name := range sortedKeys(level) {
+			fmt.Fprintf(out, "%v fill at depth %v\t%.3f\n", name, depth, level[name])
+		}
+	}
+	return nil
+}
+
+func sortedKeys(m interface{}) []string {
+	keys := []string{}
+	switch m := m.(type) {
+	case map[string]int:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	case map[string]float64:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func exportCommand(st store.BlockStore, args []string) error {
+	if len(args) != 3 {
+		return errUsage
+	}
+
+	kind := map[string]store.Kind{"seq": store.KindSeq, "set": store.KindSet}[args[0]]
+	if kind == 0 {
+		return errUsage
+	}
+
+	root, err := parseStoredRoot(st, args[1])
+	if err != nil {
+		return err
+	}
+	if root == "" {
+		return errors.New("can't export an empty tree")
+	}
+
+	if args[2] == "-" {
+		return store.Export(os.Stdout, st, root, kind)
+	}
+
+	file, err := os.Create(args[2])
+	if err != nil {
+		return err
+	}
+
+	err = store.Export(file, st, root, kind)
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func importCommand(st store.BlockStore, args []string, out io.Writer) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+
+	in, err := openInput(args[0])
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	header, err := store.Import(in, st)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(out, "%v\t%v\n", header.Kind, header.Root)
+	return nil
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"github.com/krl/bloomtree/bloomset"
+	"github.com/krl/bloomtree/common"
+	"github.com/krl/bloomtree/filter"
+	"github.com/krl/bloomtree/store"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// tempStore opens a block file in a new temporary directory
+func tempStore(t *testing.T) (*store.FileStore, func()) {
+	dir, err := ioutil.TempDir("", "bloomtree")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	st, err := store.OpenFileStore(filepath.Join(dir, "blocks"))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return st, func() {
+		st.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// runLine runs a command and returns its output, trimmed
+func runLine(t *testing.T, st *store.FileStore, args ...string) string {
+	var out bytes.Buffer
+	err := run(st, args, &out)
+	if err != nil {
+		t.Fatalf("%v: %v", args, err)
+	}
+	return strings.TrimSpace(out.String())
+}
+
+func TestSeqCommands(t *testing.T) {
+	st, done := tempStore(t)
+	defer done()
+
+	root := runLine(t, st, "seq", "insert", "empty", "0", "wonk", "donk")
+	root = runLine(t, st, "seq", "insert", root, "1", "bonk")
+
+	if n := runLine(t, st, "seq", "len", root); n != "3" {
+		t.Fatalf("Should hold 3 values, holds %v", n)
+	}
+	if v := runLine(t, st, "seq", "get", root, "1"); v != "bonk" {
+		t.Fatalf("Should get bonk at 1, got %q", v)
+	}
+
+	root = runLine(t, st, "seq", "remove", root, "0")
+	if d := runLine(t, st, "seq", "dump", root); d != "0\tbonk\n1\tdonk" {
+		t.Fatalf("Should dump the values left, got %q", d)
+	}
+
+	if r := runLine(t, st, "verify", "seq", root); r != "3 blocks checked" {
+		t.Fatalf("Should verify the sequence, got %q", r)
+	}
+
+	for _, args := range [][]string{
+		{"seq", "get", root, "2"},
+		{"seq", "remove", root, "5"},
+		{"seq", "insert", root, "3", "wonk"},
+		{"seq", "len", strings.Repeat("00", 34)},
+		{"seq", "insert", root, "0", "-", "-"},
+	} {
+		if err := run(st, args, ioutil.Discard); err == nil {
+			t.Fatalf("Should refuse %v", args)
+		}
+	}
+}
+
+func TestSetCommands(t *testing.T) {
+	st, done := tempStore(t)
+	defer done()
+
+	root := runLine(t, st, "set", "insert", "empty", "wonk donk", "donk", "bonk")
+	if found := runLine(t, st, "set", "find", root, "donk"); found != "donk\nwonk donk" && found != "wonk donk\ndonk" {
+		t.Fatalf("Should find both values with donk, got %q", found)
+	}
+
+	root = runLine(t, st, "set", "remove", root, "donk")
+	if found := runLine(t, st, "set", "find", root, "donk"); found != "wonk donk" {
+		t.Fatalf("Should have removed donk, got %q", found)
+	}
+
+	if r := runLine(t, st, "verify", "set", "empty"); !strings.HasPrefix(r, "0 blocks checked") {
+		t.Fatalf("Should report the empty tree, got %q", r)
+	}
+
+	// values of a keyed set need keyed filters, which the command
+	// can't give, so it fails instead of panicking
+	k, _ := filter.NewKey([]byte("secret"), "")
+	keyed, _ := bloomset.NewBloomSet(common.DeserializeTextValue, nil).WithKey(k)
+	keyed = keyed.Insert(keyedText{"wonk", k})
+	keyedRoot := keyed.Persist(st).Root().String()
+
+	for _, args := range [][]string{
+		{"set", "insert", keyedRoot, "donk"},
+		{"set", "remove", keyedRoot, "wonk"},
+		{"set", "insert", root, "-", "-"},
+		{"verify", "bogus", root},
+	} {
+		if err := run(st, args, ioutil.Discard); err == nil {
+			t.Fatalf("Should refuse %v", args)
+		}
+	}
+}
+
+func TestStdin(t *testing.T) {
+	st, done := tempStore(t)
+	defer done()
+
+	stdin = strings.NewReader("from stdin")
+	defer func() { stdin = os.Stdin }()
+
+	root := runLine(t, st, "seq", "insert", "empty", "0", "-")
+	if v := runLine(t, st, "seq", "get", root, "0"); v != "from stdin" {
+		t.Fatalf("Should read the value from stdin, got %q", v)
+	}
+}
+
+func TestArchiveCommands(t *testing.T) {
+	st, done := tempStore(t)
+	defer done()
+
+	root := runLine(t, st, "seq", "insert", "empty", "0", "wonk", "donk")
+
+	dir, _ := ioutil.TempDir("", "bloomtree")
+	defer os.RemoveAll(dir)
+	archive := filepath.Join(dir, "archive")
+
+	runLine(t, st, "export", "seq", root, archive)
+
+	other, otherDone := tempStore(t)
+	defer otherDone()
+
+	if imported := runLine(t, other, "import", archive); imported != "seq\t"+root {
+		t.Fatalf("Should import the sequence, got %q", imported)
+	}
+	if v := runLine(t, other, "seq", "get", root, "1"); v != "donk" {
+		t.Fatalf("Should read the imported sequence, got %q", v)
+	}
+}
+
+// a text value with a keyed words filter
+type keyedText struct {
+	word string
+	key  *filter.Key
+}
+
+func (v keyedText) Serialize() []byte {
+	return []byte(v.word)
+}
+
+func (v keyedText) GetFilter() filter.Filter {
+	f := common.TextSchema.New().Keyed(v.key)
+	f["words"].Add([]byte(v.word))
+	f["count"].Add(common.BytesFromInt(1))
+	return f
+}
@@ -45,8 +45,14 @@ func NewTextValue(s string) Value {
 	return TextValue{Content: s}
 }
 
+// TextSchema declares the filters of a TextValue
+var TextSchema = filter.Schema{
+	{Name: "words", Bits: 256, Hashes: 3},
+	{Name: "count", Bits: 256, Hashes: 3},
+}
+
 func TextFilter(word string) filter.Filter {
-	filt := filter.NewFilter(32)
+	filt := TextSchema.NewField("words")
 	filt.Add([]byte(word))
 	return filter.Filter{
 		"words": filt,
@@ -57,7 +63,7 @@ func CountFilter(i uint64) filter.Filter {
 	b := make([]byte, 8)
 	binary.PutUvarint(b, i)
 
-	filt := filter.NewFilter(32)
+	filt := TextSchema.NewField("count")
 	filt.Add(b)
 
 	return filter.Filter{
@@ -67,8 +73,8 @@ func CountFilter(i uint64) filter.Filter {
 
 func (t TextValue) GetFilter() filter.Filter {
 
-	wordfilter := filter.NewFilter(32)
-	countfilter := filter.NewFilter(32)
+	wordfilter := TextSchema.NewField("words")
+	countfilter := TextSchema.NewField("count")
 
 	var count uint64 = 0
 
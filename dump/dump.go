@@ -0,0 +1,108 @@
+// Package dump writes the structure of a tree, as described by the
+// sequence and set packages, as JSON or as a Graphviz graph.
+package dump
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// how many bytes of a leaf value a dump shows
+const previewLength = 32
+
+// Node describes a node of a tree. A node below the depth limit of a
+// dump is not loaded, and only has its key.
+type Node struct {
+	Type     string             `json:"type"`
+	Key      string             `json:"key,omitempty"`
+	Count    uint64             `json:"count,omitempty"`
+	Fill     map[string]float64 `json:"fill,omitempty"`
+	Preview  string             `json:"preview,omitempty"`
+	Children []Node             `json:"children,omitempty"`
+}
+
+func (n Node) label() string {
+	lines := []string{n.Type}
+
+	if n.Count > 0 {
+		lines = append(lines, fmt.Sprintf("count %v", n.Count))
+	}
+	if len(n.Key) > 16 {
+		lines = append(lines, n.Key[:16]+"…")
+	}
+
+	names := make([]string, 0, len(n.Fill))
+	for name := range n.Fill {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		lines = append(lines, fmt.Sprintf("%v %.2f", name, n.Fill[name]))
+	}
+
+	if n.Preview != "" {
+		lines = append(lines, n.Preview)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Preview returns the start of a value, with unprintable characters
+// replaced
+func Preview(value []byte) string {
+	if len(value) > previewLength {
+		value = value[:previewLength]
+	}
+
+	return strings.Map(func(r rune) rune {
+		if !unicode.IsPrint(r) {
+			return '.'
+		}
+		return r
+	}, string(value))
+}
+
+// WriteJSON writes the tree to w, or null for an empty tree
+func WriteJSON(w io.Writer, root *Node) error {
+	if root == nil {
+		_, err := io.WriteString(w, "null\n")
+		return err
+	}
+	return json.NewEncoder(w).Encode(root)
+}
+
+// WriteDOT writes the tree to w as a Graphviz graph of the given name,
+// with no nodes for an empty tree
+func WriteDOT(w io.Writer, name string, root *Node) error {
+	out := bufio.NewWriter(w)
+
+	fmt.Fprintf(out, "digraph %v {\n", name)
+	fmt.Fprintln(out, "\tnode [shape=box, fontname=monospace];")
+
+	if root != nil {
+		next := 0
+
+		var write func(n Node) int
+		write = func(n Node) int {
+			id := next
+			next++
+
+			fmt.Fprintf(out, "\tn%v [label=%v];\n", id, strconv.Quote(n.label()))
+			for _, c := range n.Children {
+				fmt.Fprintf(out, "\tn%v -> n%v;\n", id, write(c))
+			}
+			return id
+		}
+
+		write(*root)
+	}
+
+	fmt.Fprintln(out, "}")
+	return out.Flush()
+}
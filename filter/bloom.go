@@ -0,0 +1,253 @@
+package filter
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/fnv"
+)
+
+// Hashing picks how a bloom filter maps keys to bits
+type Hashing uint8
+
+const (
+	// the chained fnv32a hashes of go-ipfs blocks/bloom, which all
+	// filters persisted before hashing could be picked use
+	Legacy Hashing = 0
+
+	// 128 bit murmur3, the two halves combined by double hashing
+	Murmur3 Hashing = 1
+
+	// murmur3, with all the bits of a key in one block of 64 bytes,
+	// so that a lookup touches a single cache line
+	Blocked Hashing = 2
+)
+
+// the size of the blocks of blocked filters
+const blockBytes = 64
+
+// the number of hashes of legacy filters
+const legacyHashes = 3
+
+// Bloom is a bloom filter of one field
+type Bloom struct {
+	bits    []byte
+	hashes  int
+	hashing Hashing
+
+	// only held in memory, filters read back are not keyed
+	key *Key
+}
+
+var ErrMismatch = errors.New("filters differ in type, size or hashing")
+
+// NewBloom returns an empty filter of the given number of bits, which
+// is rounded up to whole bytes, or whole blocks for blocked filters
+func NewBloom(bits int, hashes int, hashing Hashing) *Bloom {
+	if hashing == Blocked {
+		block := blockBytes * 8
+		bits = (bits + block - 1) / block * block
+	}
+
+	return &Bloom{
+		bits:    make([]byte, (bits+7)/8),
+		hashes:  hashes,
+		hashing: hashing,
+	}
+}
+
+// NewFilter returns an empty legacy filter of size bytes
+func NewFilter(size int) *Bloom {
+	return NewBloom(size*8, legacyHashes, Legacy)
+}
+
+// BloomFromBytes returns a filter holding the bits. A hash count of 0
+// means the legacy count.
+func BloomFromBytes(b []byte, hashes int, hashing Hashing) *Bloom {
+	if hashes == 0 {
+		hashes = legacyHashes
+	}
+	return &Bloom{
+		bits:    append([]byte{}, b...),
+		hashes:  hashes,
+		hashing: hashing,
+	}
+}
+
+func (b *Bloom) Hashes() int {
+	return b.hashes
+}
+
+func (b *Bloom) Hashing() Hashing {
+	return b.hashing
+}
+
+// IsLegacy tells if the filter is hashed like go-ipfs blocks/bloom
+func (b *Bloom) IsLegacy() bool {
+	return b.hashing == Legacy && b.hashes == legacyHashes
+}
+
+func (b *Bloom) GetBytes() []byte {
+	return b.bits
+}
+
+// indices returns the bits set for a key, in buf if it is big enough
+func (b *Bloom) indices(key []byte, buf []uint32) []uint32 {
+	size := uint64(len(b.bits)) * 8
+
+	if size == 0 {
+		return buf[:0]
+	}
+
+	indices := buf[:0]
+	if cap(buf) < b.hashes {
+		indices = make([]uint32, 0, b.hashes)
+	}
+	indices = indices[:b.hashes]
+
+	switch b.hashing {
+	case Murmur3:
+		h1, h2 := murmur3(key)
+		for i := range indices {
+			indices[i] = uint32((h1 + uint64(i)*h2) % size)
+		}
+
+	case Blocked:
+		h1, h2 := murmur3(key)
+
+		// filters smaller than a block are one block
+		block := uint64(blockBytes * 8)
+		if size < block {
+			block = size
+		}
+
+		start := h1 % (size / block) * block
+		step := h1>>32 | 1
+
+		if block&(block-1) != 0 {
+			for i := range indices {
+				indices[i] = uint32(start + (h2+uint64(i)*step)%block)
+			}
+			break
+		}
+
+		// an odd step gives distinct bits in a power of two
+		for i := range indices {
+			indices[i] = uint32(start + (h2+uint64(i)*step)&(block-1))
+		}
+
+	default:
+		// every hash is the last one, continued with its own bytes
+		h := fnv.New32a()
+		h.Write(key)
+		buf := make([]byte, 4)
+
+		for i := range indices {
+			res := h.Sum32()
+			indices[i] = uint32(uint64(res) % size)
+
+			binary.LittleEndian.PutUint32(buf, res)
+			h.Write(buf)
+		}
+	}
+	return indices
+}
+
+// enough for the indices of most filters
+const indexBuffer = 16
+
+func (b *Bloom) Add(key []byte) {
+	var buf [indexBuffer]uint32
+
+	if b.key != nil {
+		key = mac(b.key.key, key)
+	}
+
+	for _, i := range b.indices(key, buf[:]) {
+		b.bits[i/8] |= 1 << (i % 8)
+	}
+}
+
+func (b *Bloom) Find(key []byte) bool {
+	var buf [indexBuffer]uint32
+
+	if b.key != nil {
+		key = mac(b.key.key, key)
+	}
+
+	for _, i := range b.indices(key, buf[:]) {
+		if b.bits[i/8]&(1<<(i%8)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (b *Bloom) matches(o *Bloom) bool {
+	return len(b.bits) == len(o.bits) && b.hashes == o.hashes && b.hashing == o.hashing
+}
+
+// the other filter, if it is a bloom filter like b
+func (b *Bloom) like(o Membership) (*Bloom, bool) {
+	ob, ok := o.(*Bloom)
+	return ob, ok && b.matches(ob)
+}
+
+func (b *Bloom) Merge(m Membership) (Membership, error) {
+	o, ok := b.like(m)
+	if !ok {
+		return nil, ErrMismatch
+	}
+
+	merged := &Bloom{
+		bits:    make([]byte, len(b.bits)),
+		hashes:  b.hashes,
+		hashing: b.hashing,
+		key:     b.key,
+	}
+	if merged.key == nil {
+		merged.key = o.key
+	}
+	or(merged.bits, b.bits, o.bits)
+	return merged, nil
+}
+
+func (b *Bloom) HammingDistance(o *Bloom) (int, error) {
+	if !b.matches(o) {
+		return 0, ErrMismatch
+	}
+
+	return popcountXor(b.bits, o.bits), nil
+}
+
+func (b *Bloom) SupersetOf(o *Bloom) (bool, error) {
+	if !b.matches(o) {
+		return false, ErrMismatch
+	}
+	return covers(b.bits, o.bits), nil
+}
+
+// Test is Find, for Membership
+func (b *Bloom) Test(key []byte) bool {
+	return b.Find(key)
+}
+
+func (b *Bloom) Superset(m Membership) (bool, error) {
+	o, ok := b.like(m)
+	if !ok {
+		return false, ErrMismatch
+	}
+	return covers(b.bits, o.bits), nil
+}
+
+// Distance is the hamming distance, for Membership
+func (b *Bloom) Distance(m Membership) (int, error) {
+	o, ok := b.like(m)
+	if !ok {
+		return 0, ErrMismatch
+	}
+	return popcountXor(b.bits, o.bits), nil
+}
+
+func (b *Bloom) Bytes() []byte {
+	return b.bits
+}
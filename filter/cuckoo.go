@@ -0,0 +1,324 @@
+package filter
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+// Cuckoo is a cuckoo filter of 16 bit fingerprints in buckets of 4.
+// Unlike a bloom filter, it can take back keys it was given. A key can
+// be in one of two buckets, the second found from the first and the
+// fingerprint alone, so that filters can be merged and compared by
+// their fingerprints.
+//
+// A filter that can't place a fingerprint is saturated, and tests
+// every key true, as a full bloom filter does.
+type Cuckoo struct {
+	// 0 is an empty slot
+	slots []uint16
+	full  bool
+
+	// only held in memory, as for blooms
+	key *Key
+}
+
+const (
+	bucketSlots = 4
+	bucketBytes = bucketSlots * 2
+
+	// fingerprints moved to place a new one before giving up
+	maxKicks = 500
+
+	// held in every slot of a saturated filter, no fingerprint is
+	saturatedSlot = 0xffff
+)
+
+var ErrBadCuckoo = errors.New("bad cuckoo filter")
+
+// NewCuckoo returns an empty filter of at least the given number of
+// bits, rounded up to a power of two of buckets of 64 bits
+func NewCuckoo(bits int) *Cuckoo {
+	buckets := 1
+	for buckets*bucketBytes*8 < bits {
+		buckets *= 2
+	}
+	return &Cuckoo{slots: make([]uint16, buckets*bucketSlots)}
+}
+
+// CuckooFromBytes returns the filter Bytes returned
+func CuckooFromBytes(b []byte) (*Cuckoo, error) {
+	buckets := len(b) / bucketBytes
+	if len(b)%bucketBytes != 0 || buckets == 0 || buckets&(buckets-1) != 0 {
+		return nil, ErrBadCuckoo
+	}
+
+	c := &Cuckoo{slots: make([]uint16, len(b)/2)}
+	saturated := 0
+	for i := range c.slots {
+		c.slots[i] = binary.LittleEndian.Uint16(b[2*i:])
+		if c.slots[i] == saturatedSlot {
+			saturated++
+		}
+	}
+
+	switch saturated {
+	case 0:
+	case len(c.slots):
+		c.full = true
+	default:
+		return nil, ErrBadCuckoo
+	}
+	return c, nil
+}
+
+func (c *Cuckoo) mask() uint32 {
+	return uint32(len(c.slots)/bucketSlots - 1)
+}
+
+// locate returns the fingerprint and first bucket of a key
+func (c *Cuckoo) locate(key []byte) (uint16, uint32) {
+	if c.key != nil {
+		key = mac(c.key.key, key)
+	}
+
+	h1, h2 := murmur3(key)
+	return uint16(h2%(saturatedSlot-1)) + 1, uint32(h1) & c.mask()
+}
+
+// alt returns the other bucket of a fingerprint
+func (c *Cuckoo) alt(i uint32, fp uint16) uint32 {
+	return (i ^ uint32(fp)*0x5bd1e995) & c.mask()
+}
+
+func (c *Cuckoo) bucket(i uint32) []uint16 {
+	return c.slots[i*bucketSlots : (i+1)*bucketSlots]
+}
+
+func (c *Cuckoo) has(i uint32, fp uint16) bool {
+	for _, s := range c.bucket(i) {
+		if s == fp {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Cuckoo) contains(i uint32, fp uint16) bool {
+	return c.full || c.has(i, fp) || c.has(c.alt(i, fp), fp)
+}
+
+func (c *Cuckoo) place(i uint32, fp uint16) bool {
+	bucket := c.bucket(i)
+	for j, s := range bucket {
+		if s == 0 {
+			bucket[j] = fp
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Cuckoo) insert(i uint32, fp uint16) {
+	if c.full || c.place(i, fp) || c.place(c.alt(i, fp), fp) {
+		return
+	}
+
+	// move fingerprints to their other bucket, the same ones every
+	// time so that equal filters stay equal
+	for n := 0; n < maxKicks; n++ {
+		bucket := c.bucket(i)
+		fp, bucket[n%bucketSlots] = bucket[n%bucketSlots], fp
+		i = c.alt(i, fp)
+		if c.place(i, fp) {
+			return
+		}
+	}
+	c.saturate()
+}
+
+// saturate makes the filter test every key true, which it has to once
+// a fingerprint is lost
+func (c *Cuckoo) saturate() {
+	c.full = true
+	for i := range c.slots {
+		c.slots[i] = saturatedSlot
+	}
+}
+
+// each calls fn with the bucket and fingerprint of every entry
+func (c *Cuckoo) each(fn func(i uint32, fp uint16) bool) bool {
+	if c.full {
+		return true
+	}
+	for n, fp := range c.slots {
+		if fp != 0 && !fn(uint32(n/bucketSlots), fp) {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *Cuckoo) copy() *Cuckoo {
+	return &Cuckoo{
+		slots: append([]uint16{}, c.slots...),
+		full:  c.full,
+		key:   c.key,
+	}
+}
+
+func (c *Cuckoo) matches(o Membership) (*Cuckoo, bool) {
+	oc, ok := o.(*Cuckoo)
+	return oc, ok && len(oc.slots) == len(c.slots)
+}
+
+// Add adds a key once, as for bloom filters, so that adding it again
+// doesn't fill the filter with copies
+func (c *Cuckoo) Add(key []byte) {
+	fp, i := c.locate(key)
+	if !c.contains(i, fp) {
+		c.insert(i, fp)
+	}
+}
+
+// Remove takes back a key given to Add, and tells if it was there. A
+// key added more than once is taken back at once, as is a key with the
+// same fingerprint in the same buckets. Keys can't be taken back from
+// saturated filters, or reliably from merged ones.
+func (c *Cuckoo) Remove(key []byte) bool {
+	if c.full {
+		return false
+	}
+
+	fp, i := c.locate(key)
+	for _, b := range []uint32{i, c.alt(i, fp)} {
+		bucket := c.bucket(b)
+		for j, s := range bucket {
+			if s == fp {
+				bucket[j] = 0
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (c *Cuckoo) Test(key []byte) bool {
+	fp, i := c.locate(key)
+	return c.contains(i, fp)
+}
+
+func (c *Cuckoo) Superset(o Membership) (bool, error) {
+	oc, ok := c.matches(o)
+	if !ok {
+		return false, ErrMismatch
+	}
+	if c.full {
+		return true, nil
+	}
+	if oc.full {
+		return false, nil
+	}
+
+	return oc.each(c.contains), nil
+}
+
+// Merge returns a filter with the fingerprints of both, saturated if
+// they don't fit
+func (c *Cuckoo) Merge(o Membership) (Membership, error) {
+	oc, ok := c.matches(o)
+	if !ok {
+		return nil, ErrMismatch
+	}
+
+	merged := c.copy()
+	if merged.key == nil {
+		merged.key = oc.key
+	}
+	if oc.full {
+		merged.saturate()
+	}
+
+	oc.each(func(i uint32, fp uint16) bool {
+		if !merged.contains(i, fp) {
+			merged.insert(i, fp)
+		}
+		return true
+	})
+	return merged, nil
+}
+
+func (c *Cuckoo) Bytes() []byte {
+	b := make([]byte, len(c.slots)*2)
+	for i, s := range c.slots {
+		binary.LittleEndian.PutUint16(b[2*i:], s)
+	}
+	return b
+}
+
+// Distance counts the fingerprints only one of the filters has, where
+// saturated filters have all of them
+func (c *Cuckoo) Distance(o Membership) (int, error) {
+	oc, ok := c.matches(o)
+	if !ok {
+		return 0, ErrMismatch
+	}
+
+	missing := func(a, b *Cuckoo) int {
+		if b.full {
+			return 0
+		}
+		if a.full {
+			return len(a.slots) - b.Len()
+		}
+		n := 0
+		a.each(func(i uint32, fp uint16) bool {
+			if !b.contains(i, fp) {
+				n++
+			}
+			return true
+		})
+		return n
+	}
+	return missing(c, oc) + missing(oc, c), nil
+}
+
+// Len returns the number of fingerprints, all slots when saturated
+func (c *Cuckoo) Len() int {
+	if c.full {
+		return len(c.slots)
+	}
+	n := 0
+	for _, s := range c.slots {
+		if s != 0 {
+			n++
+		}
+	}
+	return n
+}
+
+// EstimateCardinality returns the number of keys, up to fingerprints
+// shared by keys, which is infinite for a saturated filter
+func (c *Cuckoo) EstimateCardinality() float64 {
+	if c.full {
+		return math.Inf(1)
+	}
+	return float64(c.Len())
+}
+
+// FalsePositiveRate returns the chance that a key never added has the
+// fingerprint of one in either of its buckets
+func (c *Cuckoo) FalsePositiveRate() float64 {
+	if c.full {
+		return 1
+	}
+	load := float64(c.Len()) / float64(len(c.slots))
+	return 1 - math.Pow(1-1/float64(saturatedSlot-1), 2*bucketSlots*load)
+}
+
+// Keyed returns a copy of the filter that hashes terms with the key
+func (c *Cuckoo) Keyed(k *Key) *Cuckoo {
+	keyed := c.copy()
+	keyed.key = k
+	return keyed
+}
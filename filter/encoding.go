@@ -0,0 +1,188 @@
+package filter
+
+import (
+	"encoding/binary"
+	"errors"
+	"math/bits"
+)
+
+// The compact encoding of the bits of a filter is a kind byte, the
+// length of the bits in bytes as a uvarint, and then either
+//
+//   raw:       the bits as they are
+//   positions: the number of bits set, then the gaps between them
+//   runs:      the lengths of the runs of cleared and set bits, in
+//              turn, starting with the cleared ones
+//
+// all numbers as uvarints. Sparse filters, as most leaf filters are,
+// come out much smaller than raw.
+
+// EncodingVersion is the version of the compact encoding, stored with
+// encoded filters so that the encoding can change later
+const EncodingVersion = 1
+
+const (
+	kindRaw       = 0
+	kindPositions = 1
+	kindRuns      = 2
+)
+
+// bigger filters than this are rejected when decoding, so that a few
+// bytes from an untrusted peer can't ask for a huge allocation; schemas
+// can't declare them either
+const maxEncodedBytes = 1 << 20
+
+var ErrBadEncoding = errors.New("bad filter encoding")
+
+// EncodeBits returns the smallest encoding of the bits
+func EncodeBits(b []byte) []byte {
+	positions := setBits(b)
+
+	best := encodeRaw(b)
+	for _, enc := range [][]byte{encodePositions(b, positions), encodeRuns(b, positions)} {
+		if len(enc) < len(best) {
+			best = enc
+		}
+	}
+	return best
+}
+
+func setBits(b []byte) []uint64 {
+	positions := make([]uint64, 0, popcount(b))
+	for i, c := range b {
+		for c != 0 {
+			positions = append(positions, uint64(i*8+bits.TrailingZeros8(c)))
+			c &= c - 1
+		}
+	}
+	return positions
+}
+
+func header(kind byte, b []byte, size int) []byte {
+	enc := make([]byte, 1, 1+binary.MaxVarintLen64+size)
+	enc[0] = kind
+	return binary.AppendUvarint(enc, uint64(len(b)))
+}
+
+func encodeRaw(b []byte) []byte {
+	return append(header(kindRaw, b, len(b)), b...)
+}
+
+func encodePositions(b []byte, positions []uint64) []byte {
+	enc := header(kindPositions, b, len(positions))
+	enc = binary.AppendUvarint(enc, uint64(len(positions)))
+
+	next := uint64(0)
+	for _, p := range positions {
+		enc = binary.AppendUvarint(enc, p-next)
+		next = p + 1
+	}
+	return enc
+}
+
+func encodeRuns(b []byte, positions []uint64) []byte {
+	enc := header(kindRuns, b, len(positions))
+
+	next := uint64(0)
+	for i := 0; i < len(positions); {
+		// a run of set bits from positions[i] to positions[j-1]
+		j := i + 1
+		for j < len(positions) && positions[j] == positions[j-1]+1 {
+			j++
+		}
+		enc = binary.AppendUvarint(enc, positions[i]-next)
+		enc = binary.AppendUvarint(enc, uint64(j-i))
+		next = positions[j-1] + 1
+		i = j
+	}
+
+	// the cleared bits at the end, if any
+	if total := uint64(len(b)) * 8; next < total {
+		enc = binary.AppendUvarint(enc, total-next)
+	}
+	return enc
+}
+
+// DecodeBits returns the bits of an encoded filter
+func DecodeBits(enc []byte) ([]byte, error) {
+	if len(enc) == 0 {
+		return nil, ErrBadEncoding
+	}
+	kind := enc[0]
+
+	size, n := binary.Uvarint(enc[1:])
+	if n <= 0 || size > maxEncodedBytes {
+		return nil, ErrBadEncoding
+	}
+	rest := enc[1+n:]
+
+	if kind == kindRaw {
+		if uint64(len(rest)) != size {
+			return nil, ErrBadEncoding
+		}
+		return append([]byte{}, rest...), nil
+	}
+
+	b := make([]byte, size)
+	total := size * 8
+	r := &uvarints{b: rest}
+
+	switch kind {
+	case kindPositions:
+		count, ok := r.next()
+		if !ok || count > total {
+			return nil, ErrBadEncoding
+		}
+
+		next := uint64(0)
+		for i := uint64(0); i < count; i++ {
+			gap, ok := r.next()
+			if !ok || gap >= total-next {
+				return nil, ErrBadEncoding
+			}
+			p := next + gap
+			b[p/8] |= 1 << (p % 8)
+			next = p + 1
+		}
+
+	case kindRuns:
+		next := uint64(0)
+		for set := false; len(r.b) > 0; set = !set {
+			run, ok := r.next()
+			if !ok || run > total-next {
+				return nil, ErrBadEncoding
+			}
+			if set {
+				for p := next; p < next+run; p++ {
+					b[p/8] |= 1 << (p % 8)
+				}
+			}
+			next += run
+		}
+		if next != total {
+			return nil, ErrBadEncoding
+		}
+
+	default:
+		return nil, ErrBadEncoding
+	}
+
+	if len(r.b) != 0 {
+		return nil, ErrBadEncoding
+	}
+	return b, nil
+}
+
+// uvarints reads the uvarints of b in turn
+type uvarints struct {
+	b []byte
+}
+
+func (r *uvarints) next() (uint64, bool) {
+	v, n := binary.Uvarint(r.b)
+	if n <= 0 {
+		return 0, false
+	}
+	r.b = r.b[n:]
+	return v, true
+}
@@ -0,0 +1,74 @@
+package filter
+
+import (
+	"math"
+)
+
+// Estimates assume the bits of keys fall at random, which blocked
+// filters only do within a block, so their false positives come out
+// somewhat higher than estimated.
+
+func (b *Bloom) Popcount() int {
+	return popcount(b.bits)
+}
+
+// Fill returns the ratio of set bits
+func (b *Bloom) Fill() float64 {
+	if len(b.bits) == 0 {
+		return 0
+	}
+	return float64(b.Popcount()) / float64(len(b.bits)*8)
+}
+
+// EstimateCardinality returns the estimated number of distinct keys
+// added to the filter, which is infinite for a full filter
+func (b *Bloom) EstimateCardinality() float64 {
+	return cardinality(b.Popcount(), len(b.bits)*8, b.hashes)
+}
+
+// cardinality estimates the keys that set so many of the bits
+func cardinality(set, size, hashes int) float64 {
+	if size == 0 {
+		return 0
+	}
+	return -float64(size) / float64(hashes) * math.Log1p(-float64(set)/float64(size))
+}
+
+// FalsePositiveRate returns the chance that a key never added is found,
+// which is 1 for a filter without bits
+func (b *Bloom) FalsePositiveRate() float64 {
+	if len(b.bits) == 0 {
+		return 1
+	}
+	return math.Pow(b.Fill(), float64(b.hashes))
+}
+
+// filters that can tell how full they are, as blooms and cuckoos can
+type estimator interface {
+	EstimateCardinality() float64
+	FalsePositiveRate() float64
+}
+
+// EstimateCardinality returns the estimated number of keys in each
+// field that can tell
+func (fs Filter) EstimateCardinality() map[string]float64 {
+	estimates := map[string]float64{}
+	for k, v := range fs {
+		if e, ok := v.(estimator); ok {
+			estimates[k] = e.EstimateCardinality()
+		}
+	}
+	return estimates
+}
+
+// FalsePositiveRate returns the chance of a false positive in each
+// field that can tell
+func (fs Filter) FalsePositiveRate() map[string]float64 {
+	rates := map[string]float64{}
+	for k, v := range fs {
+		if e, ok := v.(estimator); ok {
+			rates[k] = e.FalsePositiveRate()
+		}
+	}
+	return rates
+}
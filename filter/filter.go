@@ -1,30 +1,34 @@
 package filter
 
 import (
-	bf "github.com/ipfs/go-ipfs/blocks/bloom"
+	"sort"
 )
 
-type Filter map[string]bf.Filter
-
-func NewFilter(size int) bf.Filter {
-	return bf.NewFilter(size)
-}
+// Filter holds the filter of every field
+type Filter map[string]Membership
 
 // matches everything!
 func EmptyFilter() Filter {
 	return Filter{}
 }
 
+// AddBloom adds a field holding a legacy filter with the given bits
 func (fs Filter) AddBloom(name string, bytes []byte) Filter {
+	return fs.AddField(name, BloomFromBytes(bytes, legacyHashes, Legacy))
+}
+
+func (fs Filter) AddField(name string, m Membership) Filter {
 	if fs[name] != nil {
 		panic("cannot add already set name to filter")
 	}
 
-	fs[name] = bf.FilterFromBytes(bytes)
+	fs[name] = m
 
 	return fs
 }
 
+// Merge returns a filter with the keys of both. It panics if a field
+// differs in type, size or hashing, which Matches checks.
 func (fs1 Filter) Merge(fs2 Filter) Filter {
 
 	newfilt := Filter{}
@@ -47,24 +51,166 @@ func (fs1 Filter) Merge(fs2 Filter) Filter {
 	return newfilt
 }
 
+// Matches checks that every field both filters have is of the same
+// type, size and hashing, so that they can be merged
+func (f1 Filter) Matches(f2 Filter) error {
+	for k, v := range f1 {
+		if f2[k] != nil && !alike(v, f2[k]) {
+			return SchemaError{k, "differs in type, size or hashing"}
+		}
+	}
+	return nil
+}
+
+func alike(m1, m2 Membership) bool {
+	switch m1 := m1.(type) {
+	case *Bloom:
+		_, ok := m1.like(m2)
+		return ok
+	case *Cuckoo:
+		_, ok := m1.matches(m2)
+		return ok
+	}
+	_, err := m1.Merge(m2)
+	return err == nil
+}
+
 func (f1 Filter) HammingDistance(f2 Filter) int {
 	acc := 0
 
 	for k := range f1 {
 		if f2[k] != nil {
-			dist, _ := f1[k].HammingDistance(f2[k])
+			dist, _ := f1[k].Distance(f2[k])
 			acc += dist
 		}
 	}
 	return acc
 }
 
+// Weights scale the distance in each field, fields without a weight
+// count once
+type Weights map[string]float64
+
+// WeightedDistance is like HammingDistance, but the distance in each
+// field is normalized by the size of the field and multiplied by its
+// weight, so that small and selective fields are not drowned out by
+// wide ones
+func (f1 Filter) WeightedDistance(f2 Filter, w Weights) float64 {
+	acc := 0.0
+
+	for k := range f1 {
+		if f2[k] != nil {
+			dist, _ := f1[k].Distance(f2[k])
+			_, size := usage(f1[k])
+
+			weight, ok := w[k]
+			if !ok {
+				weight = 1
+			}
+
+			if size > 0 {
+				acc += weight * float64(dist) / float64(size)
+			}
+		}
+	}
+	return acc
+}
+
+// MayContain tells if every field of smaller is covered by the same
+// field of bigger. A field bigger doesn't have, or has with another
+// size, is not covered.
 func (bigger Filter) MayContain(smaller Filter) bool {
 	for k, _ := range smaller {
-		may, _ := bigger[k].SupersetOf(smaller[k])
+		if bigger[k] == nil {
+			return false
+		}
+		may, _ := bigger[k].Superset(smaller[k])
 		if !may {
 			return false
 		}
 	}
 	return true
 }
+
+// Popcount returns the number of set bits over all fields, counting
+// the fingerprints of cuckoo filters
+func (fs Filter) Popcount() int {
+	set := 0
+
+	for _, v := range fs {
+		used, _ := usage(v)
+		set += used
+	}
+	return set
+}
+
+// Filled returns the sorted names of the fields any key was added to
+func (fs Filter) Filled() []string {
+	names := []string{}
+	for k, v := range fs {
+		if used, _ := usage(v); used > 0 {
+			names = append(names, k)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Fill returns the ratio of set bits over all fields, or of slots in
+// use for cuckoo filters
+func (fs Filter) Fill() float64 {
+	total := 0
+
+	for _, v := range fs {
+		_, size := usage(v)
+		total += size
+	}
+
+	if total == 0 {
+		return 0
+	}
+	return float64(fs.Popcount()) / float64(total)
+}
+
+// MergedMaxFill returns the highest ratio of set bits in any one
+// field of the merged filters, without merging bloom filters
+func (f1 Filter) MergedMaxFill(f2 Filter) float64 {
+	max := 0.0
+
+	fill := func(m1, m2 Membership) float64 {
+		b1, ok1 := m1.(*Bloom)
+		b2, ok2 := m2.(*Bloom)
+
+		switch {
+		case m2 == nil && ok1:
+			return b1.Fill()
+		case ok1 && ok2 && b1.matches(b2):
+			return float64(popcountOr(b1.bits, b2.bits)) / float64(len(b1.bits)*8)
+		case m2 != nil:
+			if merged, err := m1.Merge(m2); err == nil {
+				m1 = merged
+			}
+		}
+
+		used, size := usage(m1)
+		if size == 0 {
+			return 0
+		}
+		return float64(used) / float64(size)
+	}
+
+	for k, v := range f1 {
+		if f := fill(v, f2[k]); f > max {
+			max = f
+		}
+	}
+
+	for k, v := range f2 {
+		if f1[k] == nil {
+			if f := fill(v, nil); f > max {
+				max = f
+			}
+		}
+	}
+	return max
+}
@@ -0,0 +1,593 @@
+package filter
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func TestMurmur3(t *testing.T) {
+	vectors := []struct {
+		data   string
+		h1, h2 uint64
+	}{
+		{"", 0, 0},
+		{"hello", 0xcbd8a7b341bd9b02, 0x5b1e906a48ae1d19},
+		{"The quick brown fox jumps over the lazy dog", 0xe34bbc7bbc071b6c, 0x7a433ca9c49a9347},
+	}
+
+	for _, v := range vectors {
+		h1, h2 := murmur3([]byte(v.data))
+		if h1 != v.h1 || h2 != v.h2 {
+			t.Fatalf("Wrong murmur3 of %q: %x %x", v.data, h1, h2)
+		}
+	}
+}
+
+func TestLegacyBits(t *testing.T) {
+	f := NewFilter(32)
+	f.Add([]byte("wonk"))
+
+	// as set by go-ipfs blocks/bloom
+	expected := make([]byte, 32)
+	for _, i := range []uint{12, 71, 203} {
+		expected[i/8] |= 1 << (i % 8)
+	}
+
+	if string(f.GetBytes()) != string(expected) {
+		t.Fatal("Should set the same bits as filters persisted before")
+	}
+
+	read := BloomFromBytes(f.GetBytes(), 0, Legacy)
+	if !read.Find([]byte("wonk")) || !read.IsLegacy() {
+		t.Fatal("Should read legacy filters back")
+	}
+}
+
+func TestMurmur3Bloom(t *testing.T) {
+	f := NewBloom(1024, 7, Murmur3)
+
+	for i := 0; i < 50; i++ {
+		f.Add([]byte(fmt.Sprintf("key %v", i)))
+	}
+
+	for i := 0; i < 50; i++ {
+		if !f.Find([]byte(fmt.Sprintf("key %v", i))) {
+			t.Fatal("Should find every added key")
+		}
+	}
+
+	positives := 0
+	for i := 0; i < 1000; i++ {
+		if f.Find([]byte(fmt.Sprintf("other %v", i))) {
+			positives++
+		}
+	}
+
+	// about 0.2% expected
+	if positives > 20 {
+		t.Fatalf("Too many false positives: %v in 1000", positives)
+	}
+
+	if _, err := f.Merge(NewBloom(1024, 3, Murmur3)); err != ErrMismatch {
+		t.Fatal("Should not merge filters with other hashes")
+	}
+
+	if _, err := f.SupersetOf(NewBloom(1024, 7, Legacy)); err != ErrMismatch {
+		t.Fatal("Should not compare filters with other hashing")
+	}
+}
+
+func TestBlockedBloom(t *testing.T) {
+	f := NewBloom(4000, 8, Blocked)
+
+	if len(f.GetBytes()) != 8*blockBytes {
+		t.Fatal("Should round up to whole blocks")
+	}
+
+	for i := 0; i < 100; i++ {
+		key := []byte(fmt.Sprintf("key %v", i))
+		f.Add(key)
+
+		first := f.indices(key, nil)[0] / (blockBytes * 8)
+		for _, index := range f.indices(key, nil) {
+			if index/(blockBytes*8) != first {
+				t.Fatal("Should keep the bits of a key in one block")
+			}
+		}
+	}
+
+	for i := 0; i < 100; i++ {
+		if !f.Find([]byte(fmt.Sprintf("key %v", i))) {
+			t.Fatal("Should find every added key")
+		}
+	}
+}
+
+func TestWords(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+
+	// lengths with and without a tail
+	for _, length := range []int{0, 5, 8, 64, 67} {
+		a, b := make([]byte, length), make([]byte, length)
+		r.Read(a)
+		r.Read(b)
+
+		set, union, both, diff := 0, 0, 0, 0
+		for i := range a {
+			for bit := uint(0); bit < 8; bit++ {
+				x, y := a[i]>>bit&1, b[i]>>bit&1
+				set += int(x)
+				union += int(x | y)
+				both += int(x & y)
+				diff += int(x ^ y)
+			}
+		}
+
+		merged := make([]byte, length)
+		or(merged, a, b)
+		intersected := make([]byte, length)
+		and(intersected, a, b)
+
+		if popcount(a) != set || popcountOr(a, b) != union || popcountAnd(a, b) != both || popcountXor(a, b) != diff {
+			t.Fatalf("Should count bits of %v bytes", length)
+		}
+
+		if popcount(intersected) != both || shares(a, b) != (both > 0) {
+			t.Fatalf("Should intersect bits of %v bytes", length)
+		}
+
+		if !covers(merged, a) || !covers(merged, b) {
+			t.Fatal("Should cover both merged filters")
+		}
+
+		if popcountXor(a, b) > 0 && covers(a, merged) && covers(b, merged) {
+			t.Fatal("Should not cover what isn't set")
+		}
+	}
+}
+
+func TestEncodeBits(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+
+	sparse := make([]byte, 256)
+	sparse[3], sparse[100] = 0x81, 0x10
+
+	runs := make([]byte, 256)
+	for i := 40; i < 120; i++ {
+		runs[i] = 0xff
+	}
+
+	dense := make([]byte, 256)
+	r.Read(dense)
+
+	full := bytes.Repeat([]byte{0xff}, 256)
+
+	cases := []struct {
+		name string
+		bits []byte
+		kind byte
+	}{
+		{"empty", []byte{}, kindRaw},
+		{"zeros", make([]byte, 256), kindPositions},
+		{"sparse", sparse, kindPositions},
+		{"runs", runs, kindRuns},
+		{"full", full, kindRuns},
+		{"dense", dense, kindRaw},
+	}
+
+	for _, c := range cases {
+		enc := EncodeBits(c.bits)
+		if enc[0] != c.kind {
+			t.Fatalf("Should encode %v bits as kind %v, not %v", c.name, c.kind, enc[0])
+		}
+
+		decoded, err := DecodeBits(enc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(decoded, c.bits) {
+			t.Fatalf("Should decode %v bits as encoded", c.name)
+		}
+	}
+
+	// at most a few bytes over raw
+	if len(EncodeBits(dense)) > len(dense)+3 {
+		t.Fatal("Should fall back to raw for dense bits")
+	}
+
+	bad := [][]byte{
+		{},
+		{7, 1},
+		{kindRaw, 2, 0},
+		{kindPositions, 1, 1, 8},
+		{kindPositions, 1, 2, 0},
+		{kindPositions, 1, 1, 0, 0},
+		{kindRuns, 1, 4, 3},
+		{kindRuns, 1, 4, 4, 1},
+		{kindRuns, 1, 0x80},
+		// asks for 256 MB in a few bytes
+		{kindRuns, 0x80, 0x80, 0x80, 0x80, 0x01},
+	}
+
+	for _, b := range bad {
+		if _, err := DecodeBits(b); err != ErrBadEncoding {
+			t.Fatalf("Should reject %v", b)
+		}
+	}
+}
+
+func TestEstimates(t *testing.T) {
+	for _, h := range hashings {
+		b := NewBloom(8192, 4, h.hashing)
+
+		if b.EstimateCardinality() != 0 || b.FalsePositiveRate() != 0 {
+			t.Fatalf("Should estimate nothing in an empty %v filter", h.name)
+		}
+
+		for i := 0; i < 1000; i++ {
+			b.Add([]byte(fmt.Sprintf("key %v", i)))
+		}
+
+		if n := b.EstimateCardinality(); n < 900 || n > 1100 {
+			t.Fatalf("Estimated %v keys in a %v filter of 1000", n, h.name)
+		}
+
+		// count the false positives of keys never added
+		positives := 0
+		for i := 0; i < 10000; i++ {
+			if b.Find([]byte(fmt.Sprintf("other %v", i))) {
+				positives++
+			}
+		}
+
+		rate := b.FalsePositiveRate()
+		if measured := float64(positives) / 10000; measured > 2*rate || measured < rate/2 {
+			t.Fatalf("Estimated a rate of %v in a %v filter, measured %v", rate, h.name, measured)
+		}
+	}
+
+	full := BloomFromBytes(bytes.Repeat([]byte{0xff}, 32), 3, Murmur3)
+	if !math.IsInf(full.EstimateCardinality(), 1) || full.FalsePositiveRate() != 1 {
+		t.Fatal("Should estimate endless keys in a full filter")
+	}
+
+	f := Filter{"a": NewBloom(256, 3, Murmur3), "b": NewBloom(256, 3, Murmur3)}
+	f["a"].Add([]byte("key"))
+	if n := f.EstimateCardinality(); n["a"] < 0.9 || n["a"] > 1.1 || n["b"] != 0 {
+		t.Fatalf("Should estimate every field, not %v", n)
+	}
+	if r := f.FalsePositiveRate(); r["b"] != 0 || r["a"] <= 0 {
+		t.Fatalf("Should estimate the rate of every field, not %v", r)
+	}
+}
+
+func TestKeyed(t *testing.T) {
+	secret := []byte("correct horse battery staple")
+
+	k, err := NewKey(secret, "first")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info := k.Info()
+	if info.ID != "first" || info.KDF != KDF || info.Iterations != kdfIterations || len(info.Salt) != saltBytes {
+		t.Fatalf("Should record the key derivation, not %v", info)
+	}
+
+	again, err := DeriveKey(secret, info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := DeriveKey([]byte("wrong"), info); err != ErrWrongKey {
+		t.Fatal("Should refuse a wrong secret")
+	}
+	if _, err := DeriveKey(secret, KeyInfo{KDF: "rot13"}); err != ErrUnknownKDF {
+		t.Fatal("Should refuse unknown key derivations")
+	}
+
+	// keys made before the derivation was slowed down
+	legacy := KeyInfo{KDF: LegacyKDF, Salt: info.Salt}
+	legacy.Check = (&Key{key: mac(secret, info.Salt)}).check()
+	if _, err := DeriveKey(secret, legacy); err != nil {
+		t.Fatalf("Should derive legacy keys, got %v", err)
+	}
+
+	other, _ := NewKey(secret, "second")
+
+	schema := Schema{{Name: "words", Bits: 512, Hashes: 4, Hashing: Murmur3}}
+	plain := schema.New()
+	keyed := schema.New().Keyed(k)
+
+	plain["words"].Add([]byte("secret word"))
+	keyed["words"].Add([]byte("secret word"))
+
+	if !keyed["words"].Test([]byte("secret word")) {
+		t.Fatal("Should find keyed terms")
+	}
+	if plain.HammingDistance(keyed) == 0 {
+		t.Fatal("Should set other bits with a key")
+	}
+
+	// the bits alone don't tell the term, but the same key does
+	read := BloomFromBytes(keyed["words"].Bytes(), 4, Murmur3)
+	if read.Find([]byte("secret word")) {
+		t.Fatal("Should not find keyed terms without the key")
+	}
+	if !read.Keyed(again).Find([]byte("secret word")) {
+		t.Fatal("Should find keyed terms with the key derived again")
+	}
+	if read.Keyed(other).Find([]byte("secret word")) {
+		t.Fatal("Should not find keyed terms with another key")
+	}
+
+	if info.Validate(keyed) != nil {
+		t.Fatal("Should validate filters keyed with the key")
+	}
+	if info.Validate(plain) == nil || info.Validate(schema.New().Keyed(other)) == nil {
+		t.Fatal("Should refuse filters not keyed with the key")
+	}
+}
+
+func TestIntersect(t *testing.T) {
+	fields := func(from, to int) Filter {
+		f := Filter{
+			"a": NewBloom(8192, 4, Murmur3),
+			"b": NewBloom(8192, 4, Blocked),
+			"c": NewCuckoo(16384),
+		}
+		for i := from; i < to; i++ {
+			f["a"].Add([]byte(fmt.Sprintf("key %v", i)))
+			f["b"].Add([]byte(fmt.Sprintf("key %v", i)))
+			f["c"].Add([]byte(fmt.Sprintf("key %v", i)))
+		}
+		return f
+	}
+
+	// 100 keys shared out of 500
+	f1, f2 := fields(0, 300), fields(200, 500)
+	f1["only"] = NewBloom(256, 3, Murmur3)
+	f1["sized"], f2["sized"] = NewBloom(256, 3, Murmur3), NewBloom(512, 3, Murmur3)
+
+	intersected := f1.Intersect(f2)
+	if len(intersected) != 3 || intersected["a"] == nil || intersected["b"] == nil || intersected["c"] == nil {
+		t.Fatalf("Should intersect only matching fields, not %v", intersected)
+	}
+
+	for i := 200; i < 300; i++ {
+		if !intersected.MayContain(fields(i, i+1)) {
+			t.Fatal("Should keep the keys of both filters")
+		}
+	}
+	if intersected.Popcount() >= f1.Intersect(f1).Popcount() {
+		t.Fatal("Should clear bits not set in both")
+	}
+
+	if !f1.MayIntersect(f2) {
+		t.Fatal("Should intersect filters with keys in common")
+	}
+	if fields(0, 1).MayIntersect(fields(1, 2)) {
+		t.Fatal("Should not intersect sparse filters without keys in common")
+	}
+
+	for name, j := range f1.Jaccard(f2) {
+		if j < 0.15 || j > 0.25 {
+			t.Fatalf("Estimated a similarity of %v in field %v, not 0.2", j, name)
+		}
+	}
+	if len(f1.Jaccard(f2)) != 3 {
+		t.Fatal("Should only compare matching fields")
+	}
+
+	empty := NewBloom(256, 3, Murmur3)
+	full := BloomFromBytes(bytes.Repeat([]byte{0xff}, 32), 3, Murmur3)
+
+	if j, _ := empty.Jaccard(empty); j != 1 {
+		t.Fatal("Should find empty filters the same")
+	}
+	if j, _ := full.Jaccard(empty); j != 0 {
+		t.Fatal("Should share no bits of full and empty filters")
+	}
+	if _, err := empty.Jaccard(NewBloom(512, 3, Murmur3)); err != ErrMismatch {
+		t.Fatal("Should refuse filters of other sizes")
+	}
+
+	saturated, some := NewCuckoo(512), NewCuckoo(512)
+	saturated.saturate()
+	some.Add([]byte("key"))
+	if shared, _ := saturated.Intersects(some); !shared {
+		t.Fatal("Should intersect saturated filters with any key")
+	}
+	if shared, _ := saturated.Intersects(NewCuckoo(512)); shared {
+		t.Fatal("Should not intersect empty filters")
+	}
+	if c, _ := saturated.Intersect(some); !c.Test([]byte("key")) || c.Len() != 1 {
+		t.Fatal("Should keep the keys of the other filter when saturated")
+	}
+	if _, err := some.Intersects(NewCuckoo(1024)); err != ErrMismatch {
+		t.Fatal("Should refuse cuckoo filters of other sizes")
+	}
+}
+
+func TestCuckoo(t *testing.T) {
+	c := NewCuckoo(16384)
+	if len(c.slots) != 1024 {
+		t.Fatalf("Should round up to buckets, not %v slots", len(c.slots))
+	}
+
+	for i := 0; i < 500; i++ {
+		c.Add([]byte(fmt.Sprintf("key %v", i)))
+	}
+	for i := 0; i < 500; i++ {
+		if !c.Test([]byte(fmt.Sprintf("key %v", i))) {
+			t.Fatal("Should find every added key")
+		}
+	}
+
+	positives := 0
+	for i := 0; i < 10000; i++ {
+		if c.Test([]byte(fmt.Sprintf("other %v", i))) {
+			positives++
+		}
+	}
+	if positives > 10 {
+		t.Fatalf("Should have few false positives, not %v", positives)
+	}
+
+	read, err := CuckooFromBytes(c.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d, _ := read.Distance(c); d != 0 || !read.Test([]byte("key 42")) {
+		t.Fatal("Should read back the filter it wrote")
+	}
+
+	if !c.Remove([]byte("key 42")) || c.Test([]byte("key 42")) || c.Len() != 499 {
+		t.Fatal("Should take back added keys")
+	}
+
+	// adding a key again is a no-op, or repeated words saturate
+	repeated := NewCuckoo(8192)
+	for i := 0; i < 9; i++ {
+		repeated.Add([]byte("the"))
+	}
+	if repeated.full || repeated.Len() != 1 || repeated.Test([]byte("zebra")) {
+		t.Fatal("Should add a key once")
+	}
+	if !repeated.Remove([]byte("the")) || repeated.Test([]byte("the")) {
+		t.Fatal("Should take back a key added many times at once")
+	}
+
+	// merged halves hold both
+	a, b := NewCuckoo(16384), NewCuckoo(16384)
+	for i := 0; i < 500; i++ {
+		if i%2 == 0 {
+			a.Add([]byte(fmt.Sprintf("key %v", i)))
+		} else {
+			b.Add([]byte(fmt.Sprintf("key %v", i)))
+		}
+	}
+
+	m, err := a.Merge(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, half := range []*Cuckoo{a, b} {
+		if ok, _ := m.Superset(half); !ok {
+			t.Fatal("Should merge both filters")
+		}
+		if ok, _ := half.Superset(m); ok {
+			t.Fatal("Should not cover the merged filter with half of it")
+		}
+	}
+	if d, _ := m.Distance(a); d != b.Len() {
+		t.Fatalf("Should differ by the other half, not %v", d)
+	}
+
+	if _, err := a.Merge(NewCuckoo(8192)); err != ErrMismatch {
+		t.Fatal("Should refuse filters of another size")
+	}
+	if _, err := a.Superset(NewBloom(16384, 3, Murmur3)); err != ErrMismatch {
+		t.Fatal("Should refuse filters of another type")
+	}
+
+	// a single bucket can't hold many keys
+	small := NewCuckoo(64)
+	for i := 0; i < 20; i++ {
+		small.Add([]byte(fmt.Sprintf("key %v", i)))
+	}
+	if !small.full || !small.Test([]byte("anything")) || small.FalsePositiveRate() != 1 {
+		t.Fatal("Should saturate when keys don't fit")
+	}
+
+	full, err := CuckooFromBytes(small.Bytes())
+	if err != nil || !full.full {
+		t.Fatal("Should read back saturated filters")
+	}
+	if ok, _ := full.Superset(NewCuckoo(64)); !ok {
+		t.Fatal("Should cover anything when saturated")
+	}
+
+	for _, bad := range [][]byte{{}, make([]byte, 24), {0xff, 0xff, 1, 0, 0, 0, 0, 0}} {
+		if _, err := CuckooFromBytes(bad); err != ErrBadCuckoo {
+			t.Fatalf("Should refuse %v", bad)
+		}
+	}
+
+	schema := Schema{{Name: "words", Type: CuckooType, Bits: 4096}}
+	if err := schema.Check(); err != nil {
+		t.Fatal(err)
+	}
+	if err := (Schema{{Name: "words", Type: CuckooType, Bits: 3 * 64}}).Check(); err == nil {
+		t.Fatal("Should refuse cuckoo filters of odd numbers of buckets")
+	}
+	if err := schema.ValidateValue(Filter{"words": NewBloom(4096, 3, Murmur3)}); err == nil {
+		t.Fatal("Should refuse filters of another type than the schema")
+	}
+	if err := schema.ValidateValue(schema.New()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+var hashings = []struct {
+	name    string
+	hashing Hashing
+}{
+	{"legacy", Legacy},
+	{"murmur3", Murmur3},
+	{"blocked", Blocked},
+}
+
+func BenchmarkFind(b *testing.B) {
+	// enough keys and bits that lookups miss the cache
+	keys := make([][]byte, 1<<18)
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("key %v", i))
+	}
+
+	for _, h := range hashings {
+		f := NewBloom(1<<28, 7, h.hashing)
+		for _, key := range keys[:len(keys)/2] {
+			f.Add(key)
+		}
+
+		b.Run(h.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				f.Find(keys[i%len(keys)])
+			}
+		})
+	}
+}
+
+func BenchmarkSupersetOf(b *testing.B) {
+	big, small := NewBloom(1<<16, 3, Murmur3), NewBloom(1<<16, 3, Murmur3)
+	for i := 0; i < 1000; i++ {
+		key := []byte(fmt.Sprintf("key %v", i))
+		big.Add(key)
+		if i%10 == 0 {
+			small.Add(key)
+		}
+	}
+
+	for i := 0; i < b.N; i++ {
+		big.SupersetOf(small)
+	}
+}
+
+func BenchmarkMerge(b *testing.B) {
+	f1, f2 := NewBloom(1<<16, 3, Murmur3), NewBloom(1<<16, 3, Murmur3)
+
+	for i := 0; i < b.N; i++ {
+		f1.Merge(f2)
+	}
+}
+
+func BenchmarkHammingDistance(b *testing.B) {
+	f1, f2 := NewBloom(1<<16, 3, Murmur3), NewBloom(1<<16, 3, Murmur3)
+
+	for i := 0; i < b.N; i++ {
+		f1.HammingDistance(f2)
+	}
+}
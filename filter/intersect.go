@@ -0,0 +1,230 @@
+package filter
+
+import (
+	"math"
+)
+
+// Intersect returns the bits set in both filters, which hold the keys
+// added to both, and some more
+func (b *Bloom) Intersect(o *Bloom) (*Bloom, error) {
+	if !b.matches(o) {
+		return nil, ErrMismatch
+	}
+
+	intersected := &Bloom{
+		bits:    make([]byte, len(b.bits)),
+		hashes:  b.hashes,
+		hashing: b.hashing,
+		key:     b.key,
+	}
+	if intersected.key == nil {
+		intersected.key = o.key
+	}
+	and(intersected.bits, b.bits, o.bits)
+	return intersected, nil
+}
+
+// Intersects tells if any bit is set in both filters, which it is if
+// a key was added to both
+func (b *Bloom) Intersects(o *Bloom) (bool, error) {
+	if !b.matches(o) {
+		return false, ErrMismatch
+	}
+	return shares(b.bits, o.bits), nil
+}
+
+// Jaccard estimates the share of the keys added to either filter that
+// were added to both, from the cardinalities of the filters and their
+// union. Full filters, which give no estimate, fall back to the share
+// of set bits set in both. Two empty filters are the same.
+func (b *Bloom) Jaccard(o *Bloom) (float64, error) {
+	if !b.matches(o) {
+		return 0, ErrMismatch
+	}
+
+	union := popcountOr(b.bits, o.bits)
+	if union == 0 {
+		return 1, nil
+	}
+
+	size := len(b.bits) * 8
+	nb, no := b.EstimateCardinality(), o.EstimateCardinality()
+	nu := cardinality(union, size, b.hashes)
+
+	if math.IsInf(nu, 1) {
+		return float64(popcountAnd(b.bits, o.bits)) / float64(union), nil
+	}
+
+	jaccard := (nb + no - nu) / nu
+	return math.Max(0, math.Min(1, jaccard)), nil
+}
+
+// Intersect returns the fingerprints of c that o has in the same pair
+// of buckets, which hold the keys added to both, and some more. A
+// saturated filter has every fingerprint.
+func (c *Cuckoo) Intersect(o *Cuckoo) (*Cuckoo, error) {
+	if _, ok := c.matches(o); !ok {
+		return nil, ErrMismatch
+	}
+
+	var intersected *Cuckoo
+	switch {
+	case c.full:
+		intersected = o.copy()
+	case o.full:
+		intersected = c.copy()
+	default:
+		intersected = c.copy()
+		for n, fp := range intersected.slots {
+			if fp != 0 && !o.contains(uint32(n/bucketSlots), fp) {
+				intersected.slots[n] = 0
+			}
+		}
+	}
+
+	if intersected.key == nil {
+		intersected.key = c.key
+	}
+	if intersected.key == nil {
+		intersected.key = o.key
+	}
+	return intersected, nil
+}
+
+// Intersects tells if the filters share a fingerprint in the same pair
+// of buckets, which they do if a key was added to both
+func (c *Cuckoo) Intersects(o *Cuckoo) (bool, error) {
+	if _, ok := c.matches(o); !ok {
+		return false, ErrMismatch
+	}
+
+	switch {
+	case c.full:
+		return o.Len() > 0, nil
+	case o.full:
+		return c.Len() > 0, nil
+	}
+	return !c.each(func(i uint32, fp uint16) bool {
+		return !o.contains(i, fp)
+	}), nil
+}
+
+// Jaccard returns the share of the fingerprints of either filter that
+// both have, where saturated filters have all of them. Two empty
+// filters are the same.
+func (c *Cuckoo) Jaccard(o *Cuckoo) (float64, error) {
+	if _, ok := c.matches(o); !ok {
+		return 0, ErrMismatch
+	}
+
+	shared := 0
+	switch {
+	case c.full:
+		shared = o.Len()
+	case o.full:
+		shared = c.Len()
+	default:
+		c.each(func(i uint32, fp uint16) bool {
+			if o.contains(i, fp) {
+				shared++
+			}
+			return true
+		})
+	}
+
+	union := c.Len() + o.Len() - shared
+	if union == 0 {
+		return 1, nil
+	}
+	return math.Max(0, math.Min(1, float64(shared)/float64(union))), nil
+}
+
+// intersect returns the keys of two filters of a field in common
+func intersect(m1, m2 Membership) (Membership, error) {
+	switch m1 := m1.(type) {
+	case *Bloom:
+		if b2, ok := m2.(*Bloom); ok {
+			b, err := m1.Intersect(b2)
+			if err != nil {
+				return nil, err
+			}
+			return b, nil
+		}
+	case *Cuckoo:
+		if c2, ok := m2.(*Cuckoo); ok {
+			c, err := m1.Intersect(c2)
+			if err != nil {
+				return nil, err
+			}
+			return c, nil
+		}
+	}
+	return nil, ErrMismatch
+}
+
+func intersects(m1, m2 Membership) (bool, error) {
+	switch m1 := m1.(type) {
+	case *Bloom:
+		if b2, ok := m2.(*Bloom); ok {
+			return m1.Intersects(b2)
+		}
+	case *Cuckoo:
+		if c2, ok := m2.(*Cuckoo); ok {
+			return m1.Intersects(c2)
+		}
+	}
+	return false, ErrMismatch
+}
+
+func jaccard(m1, m2 Membership) (float64, error) {
+	switch m1 := m1.(type) {
+	case *Bloom:
+		if b2, ok := m2.(*Bloom); ok {
+			return m1.Jaccard(b2)
+		}
+	case *Cuckoo:
+		if c2, ok := m2.(*Cuckoo); ok {
+			return m1.Jaccard(c2)
+		}
+	}
+	return 0, ErrMismatch
+}
+
+// Intersect returns the fields both filters have, with the keys added
+// to both. Fields only one filter has, or that differ in type, size or
+// hashing, are left out, as no key is known to be in both.
+func (f1 Filter) Intersect(f2 Filter) Filter {
+	intersected := Filter{}
+
+	for k, v := range f1 {
+		if m, err := intersect(v, f2[k]); err == nil {
+			intersected[k] = m
+		}
+	}
+	return intersected
+}
+
+// MayIntersect tells if the filters can have a key in common, which
+// needs one in common in every field they both have. Fields that
+// differ in type, size or hashing can't tell, and are skipped.
+func (f1 Filter) MayIntersect(f2 Filter) bool {
+	for k, v := range f1 {
+		if shared, err := intersects(v, f2[k]); err == nil && !shared {
+			return false
+		}
+	}
+	return true
+}
+
+// Jaccard estimates the similarity of the filters in every field they
+// both have with the same type, size and hashing
+func (f1 Filter) Jaccard(f2 Filter) map[string]float64 {
+	similarity := map[string]float64{}
+
+	for k, v := range f1 {
+		if j, err := jaccard(v, f2[k]); err == nil {
+			similarity[k] = j
+		}
+	}
+	return similarity
+}
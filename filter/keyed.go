@@ -0,0 +1,176 @@
+package filter
+
+import (
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+)
+
+// Keyed filters hash HMAC-SHA256(key, term) instead of the term, so
+// that the filter can't be tested for a guessed term without the key.
+// The key is derived from a secret and a random salt, and only the
+// salt and a check value are stored with a set.
+//
+// The check value lets anyone holding the blocks test guessed secrets
+// offline, slowed only by the derivation. A passphrase is as strong as
+// it is hard to guess; the secret should be a random key of 32 bytes.
+//
+// Only the filters are keyed. The data of the leaves still holds the
+// values as they were serialized, so values have to be encrypted on
+// their own for the terms in them not to leak.
+
+// KDF names the derivation of keys from secrets, PBKDF2 with SHA-256
+// for as many iterations as the key records
+const KDF = "pbkdf2-sha256"
+
+// LegacyKDF is the single HMAC keys were once derived with, still read
+// but no longer made
+const LegacyKDF = "hmac-sha256"
+
+const (
+	saltBytes  = 16
+	checkBytes = 8
+	keyBytes   = 32
+
+	// as recommended for PBKDF2-HMAC-SHA256 in 2023
+	kdfIterations = 600000
+)
+
+var (
+	ErrUnknownKDF = errors.New("unknown key derivation")
+	ErrWrongKey   = errors.New("secret does not match the key")
+)
+
+// KeyInfo is what a keyed set records about its key: enough to derive
+// the key again from the secret and to tell a wrong secret, but not
+// the key.
+type KeyInfo struct {
+	// picked by the user, to tell keys apart when rotating
+	ID string
+
+	KDF        string
+	Iterations int
+	Salt       []byte
+	Check      []byte
+}
+
+// Key is a secret key filters are hashed with
+type Key struct {
+	key  []byte
+	info KeyInfo
+}
+
+func mac(key, data []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+func derive(secret []byte, info KeyInfo) (*Key, error) {
+	switch info.KDF {
+	case KDF:
+		if info.Iterations < 1 {
+			return nil, ErrUnknownKDF
+		}
+		key, err := pbkdf2.Key(sha256.New, string(secret), info.Salt, info.Iterations, keyBytes)
+		if err != nil {
+			return nil, err
+		}
+		return &Key{key: key, info: info}, nil
+	case LegacyKDF:
+		return &Key{key: mac(secret, info.Salt), info: info}, nil
+	}
+	return nil, ErrUnknownKDF
+}
+
+// the check value, which tells keys apart without revealing them
+func (k *Key) check() []byte {
+	return mac(k.key, []byte("bloomtree key check"))[:checkBytes]
+}
+
+// NewKey derives a new key with a random salt from the secret
+func NewKey(secret []byte, id string) (*Key, error) {
+	salt := make([]byte, saltBytes)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return nil, err
+	}
+
+	k, err := derive(secret, KeyInfo{ID: id, KDF: KDF, Iterations: kdfIterations, Salt: salt})
+	if err != nil {
+		return nil, err
+	}
+	k.info.Check = k.check()
+	return k, nil
+}
+
+// DeriveKey derives the key a set records from the secret
+func DeriveKey(secret []byte, info KeyInfo) (*Key, error) {
+	k, err := derive(secret, info)
+	if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal(k.check(), info.Check) {
+		return nil, ErrWrongKey
+	}
+	return k, nil
+}
+
+func (k *Key) Info() KeyInfo {
+	return k.info
+}
+
+// Keyed returns a copy of the filter that hashes terms with the key.
+// Bits already set stay as they are, so it should be empty.
+func (b *Bloom) Keyed(k *Key) *Bloom {
+	return &Bloom{
+		bits:    append([]byte{}, b.bits...),
+		hashes:  b.hashes,
+		hashing: b.hashing,
+		key:     k,
+	}
+}
+
+// Keyed returns a copy of the filter with every field keyed, fields
+// of types that can't be keyed are left as they are
+func (fs Filter) Keyed(k *Key) Filter {
+	keyed := Filter{}
+	for name, m := range fs {
+		switch m := m.(type) {
+		case *Bloom:
+			keyed[name] = m.Keyed(k)
+		case *Cuckoo:
+			keyed[name] = m.Keyed(k)
+		default:
+			keyed[name] = m
+		}
+	}
+	return keyed
+}
+
+// keyOf returns the key a filter hashes with, or nil
+func keyOf(m Membership) *Key {
+	switch m := m.(type) {
+	case *Bloom:
+		return m.key
+	case *Cuckoo:
+		return m.key
+	}
+	return nil
+}
+
+// Validate checks that every field of fs is hashed with the key
+func (info KeyInfo) Validate(fs Filter) error {
+	for name, m := range fs {
+		k := keyOf(m)
+		if k == nil {
+			return SchemaError{name, "not keyed"}
+		}
+		if !hmac.Equal(k.info.Check, info.Check) {
+			return SchemaError{name, "keyed with another key"}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package filter
+
+import (
+	"fmt"
+)
+
+// Membership is the filter of one field, which tests keys with false
+// positives but without false negatives. Filters of the same type and
+// size can be compared and merged, other pairs give ErrMismatch.
+type Membership interface {
+	Add(key []byte)
+	Test(key []byte) bool
+
+	// Superset tells if every key added to o tests true here
+	Superset(o Membership) (bool, error)
+
+	Merge(o Membership) (Membership, error)
+	Bytes() []byte
+
+	// Distance tells how much two filters differ, 0 for equal ones
+	Distance(o Membership) (int, error)
+}
+
+// Type tags the kinds of Membership, as persisted
+type Type uint8
+
+const (
+	BloomType  Type = 0
+	CuckooType Type = 1
+)
+
+func (t Type) String() string {
+	switch t {
+	case BloomType:
+		return "bloom"
+	case CuckooType:
+		return "cuckoo"
+	}
+	return fmt.Sprintf("type %d", uint8(t))
+}
+
+// TypeOf returns the type tag of a filter, and false for types the
+// package doesn't know
+func TypeOf(m Membership) (Type, bool) {
+	switch m.(type) {
+	case *Bloom:
+		return BloomType, true
+	case *Cuckoo:
+		return CuckooType, true
+	}
+	return 0, false
+}
+
+// usage returns how much of a filter is used, out of its size: set
+// bits for bloom filters and fingerprints for cuckoo filters
+func usage(m Membership) (used, size int) {
+	switch m := m.(type) {
+	case *Bloom:
+		return m.Popcount(), len(m.bits) * 8
+	case *Cuckoo:
+		return m.Len(), len(m.slots)
+	}
+	b := m.Bytes()
+	return popcount(b), len(b) * 8
+}
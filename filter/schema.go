@@ -0,0 +1,143 @@
+package filter
+
+import (
+	"fmt"
+)
+
+// Field declares one named filter of a Schema. Hashes and hashing
+// are only for bloom filters.
+type Field struct {
+	Name    string
+	Type    Type
+	Bits    int
+	Hashes  int
+	Hashing Hashing
+}
+
+// Schema declares the fields of the filters of a collection
+type Schema []Field
+
+// more hashes than this only fill filters faster
+const maxHashes = 32
+
+type SchemaError struct {
+	Field   string
+	Problem string
+}
+
+func (e SchemaError) Error() string {
+	return fmt.Sprintf("filter field %q: %v", e.Field, e.Problem)
+}
+
+func (s Schema) field(name string) (Field, bool) {
+	for _, f := range s {
+		if f.Name == name {
+			return f, true
+		}
+	}
+	return Field{}, false
+}
+
+// Check tells if the schema itself can be used
+func (s Schema) Check() error {
+	seen := map[string]bool{}
+
+	for _, f := range s {
+		if seen[f.Name] {
+			return SchemaError{f.Name, "declared twice"}
+		}
+		seen[f.Name] = true
+
+		if f.Bits > maxEncodedBytes*8 {
+			return SchemaError{f.Name, fmt.Sprintf("size of %v bits is over the most of %v", f.Bits, maxEncodedBytes*8)}
+		}
+
+		switch f.Type {
+		case BloomType:
+		case CuckooType:
+			buckets := f.Bits / (bucketBytes * 8)
+			if f.Bits%(bucketBytes*8) != 0 || buckets == 0 || buckets&(buckets-1) != 0 {
+				return SchemaError{f.Name, fmt.Sprintf("size of %v bits is not a power of two of buckets of %v bytes", f.Bits, bucketBytes)}
+			}
+			continue
+		default:
+			return SchemaError{f.Name, fmt.Sprintf("unknown filter %v", f.Type)}
+		}
+
+		switch {
+		case f.Bits <= 0 || f.Bits%8 != 0:
+			return SchemaError{f.Name, fmt.Sprintf("size of %v bits is not a positive multiple of 8", f.Bits)}
+		case f.Hashes < 1 || f.Hashes > maxHashes:
+			return SchemaError{f.Name, fmt.Sprintf("%v hashes, not between 1 and %v", f.Hashes, maxHashes)}
+		case f.Hashing != Legacy && f.Hashing != Murmur3 && f.Hashing != Blocked:
+			return SchemaError{f.Name, fmt.Sprintf("unknown hashing %v", f.Hashing)}
+		case f.Hashing == Blocked && f.Bits%(blockBytes*8) != 0:
+			return SchemaError{f.Name, fmt.Sprintf("size of %v bits is not whole blocks of %v bytes", f.Bits, blockBytes)}
+		}
+	}
+	return nil
+}
+
+// New returns an empty filter with every field of the schema
+func (s Schema) New() Filter {
+	fs := Filter{}
+	for _, f := range s {
+		fs[f.Name] = s.NewField(f.Name)
+	}
+	return fs
+}
+
+// NewField returns an empty filter for the named field, or nil if the
+// schema doesn't declare it
+func (s Schema) NewField(name string) Membership {
+	f, ok := s.field(name)
+	if !ok {
+		return nil
+	}
+	if f.Type == CuckooType {
+		return NewCuckoo(f.Bits)
+	}
+	return NewBloom(f.Bits, f.Hashes, f.Hashing)
+}
+
+// validate checks that every field of fs is declared with its size,
+// and if complete is set, that no declared field is missing
+func (s Schema) validate(fs Filter, complete bool) error {
+	for name, v := range fs {
+		f, ok := s.field(name)
+		if !ok {
+			return SchemaError{name, "not in schema"}
+		}
+		if v == nil {
+			return SchemaError{name, "has no filter"}
+		}
+		if t, ok := TypeOf(v); !ok || t != f.Type {
+			return SchemaError{name, fmt.Sprintf("is not a %v filter", f.Type)}
+		}
+		if bits := len(v.Bytes()) * 8; bits != f.Bits {
+			return SchemaError{name, fmt.Sprintf("has %v bits, schema has %v", bits, f.Bits)}
+		}
+		if b, ok := v.(*Bloom); ok && (b.Hashes() != f.Hashes || b.Hashing() != f.Hashing) {
+			return SchemaError{name, "hashed differently than in schema"}
+		}
+	}
+
+	if complete {
+		for _, f := range s {
+			if fs[f.Name] == nil {
+				return SchemaError{f.Name, "missing"}
+			}
+		}
+	}
+	return nil
+}
+
+// ValidateValue checks the filter of a value, which needs all fields
+func (s Schema) ValidateValue(fs Filter) error {
+	return s.validate(fs, true)
+}
+
+// ValidateQuery checks a query filter, which can leave out fields
+func (s Schema) ValidateQuery(fs Filter) error {
+	return s.validate(fs, false)
+}
@@ -0,0 +1,132 @@
+package filter
+
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
+// The bitwise operations on filters go a word at a time, and a byte
+// at a time over the rest.
+
+func word(b []byte, i int) uint64 {
+	return binary.LittleEndian.Uint64(b[i:])
+}
+
+// or sets dst to a | b, all of the same length
+func or(dst, a, b []byte) {
+	n := len(a) &^ 7
+
+	for i := 0; i < n; i += 8 {
+		binary.LittleEndian.PutUint64(dst[i:], word(a, i)|word(b, i))
+	}
+	for i := n; i < len(a); i++ {
+		dst[i] = a[i] | b[i]
+	}
+}
+
+// and sets dst to a & b, all of the same length
+func and(dst, a, b []byte) {
+	n := len(a) &^ 7
+
+	for i := 0; i < n; i += 8 {
+		binary.LittleEndian.PutUint64(dst[i:], word(a, i)&word(b, i))
+	}
+	for i := n; i < len(a); i++ {
+		dst[i] = a[i] & b[i]
+	}
+}
+
+func popcount(b []byte) int {
+	n := len(b) &^ 7
+	set := 0
+
+	for i := 0; i < n; i += 8 {
+		set += bits.OnesCount64(word(b, i))
+	}
+	for i := n; i < len(b); i++ {
+		set += bits.OnesCount8(b[i])
+	}
+	return set
+}
+
+// popcountOr counts the bits set in a | b, b is either as long as a
+// or empty
+func popcountOr(a, b []byte) int {
+	if len(b) == 0 {
+		return popcount(a)
+	}
+
+	n := len(a) &^ 7
+	set := 0
+
+	for i := 0; i < n; i += 8 {
+		set += bits.OnesCount64(word(a, i) | word(b, i))
+	}
+	for i := n; i < len(a); i++ {
+		set += bits.OnesCount8(a[i] | b[i])
+	}
+	return set
+}
+
+// popcountAnd counts the bits set in both a and b, of the same length
+func popcountAnd(a, b []byte) int {
+	n := len(a) &^ 7
+	set := 0
+
+	for i := 0; i < n; i += 8 {
+		set += bits.OnesCount64(word(a, i) & word(b, i))
+	}
+	for i := n; i < len(a); i++ {
+		set += bits.OnesCount8(a[i] & b[i])
+	}
+	return set
+}
+
+// shares tells if any bit is set in both a and b, of the same length
+func shares(a, b []byte) bool {
+	n := len(a) &^ 7
+
+	for i := 0; i < n; i += 8 {
+		if word(a, i)&word(b, i) != 0 {
+			return true
+		}
+	}
+	for i := n; i < len(a); i++ {
+		if a[i]&b[i] != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// popcountXor counts the bits that differ in a and b, of the same
+// length
+func popcountXor(a, b []byte) int {
+	n := len(a) &^ 7
+	set := 0
+
+	for i := 0; i < n; i += 8 {
+		set += bits.OnesCount64(word(a, i) ^ word(b, i))
+	}
+	for i := n; i < len(a); i++ {
+		set += bits.OnesCount8(a[i] ^ b[i])
+	}
+	return set
+}
+
+// covers tells if every bit set in b is set in a, of the same length
+func covers(a, b []byte) bool {
+	n := len(a) &^ 7
+
+	for i := 0; i < n; i += 8 {
+		if word(b, i)&^word(a, i) != 0 {
+			return false
+		}
+	}
+	for i := n; i < len(a); i++ {
+		if b[i]&^a[i] != 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,229 @@
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// An archive holds every block of one tree. It starts with a header
+//
+//	magic
+//	version       uint8
+//	kind          uint8
+//	length of the root key  uvarint
+//	root key
+//
+// followed by a frame per block, parents before their children
+//
+//	length of the key    uvarint
+//	key
+//	length of the block  uvarint
+//	block
+//
+// and a trailer, so that an archive cut short between frames is not
+// taken for a whole one
+//
+//	0                    uvarint, an empty key
+//	number of blocks     uvarint
+type Kind uint8
+
+const (
+	KindSeq Kind = 1
+	KindSet Kind = 2
+)
+
+func (k Kind) String() string {
+	switch k {
+	case KindSeq:
+		return "seq"
+	case KindSet:
+		return "set"
+	}
+	return fmt.Sprintf("kind %d", uint8(k))
+}
+
+type Header struct {
+	Kind Kind
+	Root Key
+}
+
+const archiveVersion = 2
+
+// no key or block in an archive may be larger
+const maxFrame = 1 << 26
+
+var archiveMagic = []byte("bloomtree archive\n")
+
+var (
+	ErrBadArchive   = errors.New("not a bloomtree archive")
+	ErrHashMismatch = errors.New("block does not match its key")
+	ErrMissingRoot  = errors.New("archive does not hold its root block")
+	ErrTruncated    = errors.New("archive is truncated")
+	ErrLegacyExport = errors.New("legacy blocks can't be archived")
+)
+
+// Export writes every block reachable from root to w. Trees written
+// as merkledag nodes before their links were kept in the block can't
+// be exported, as their keys hash the links too; Sync them instead.
+func Export(w io.Writer, s BlockStore, root Key, kind Kind) error {
+	out := bufio.NewWriter(w)
+
+	out.Write(archiveMagic)
+	out.Write([]byte{archiveVersion, byte(kind)})
+	writeFrame(out, []byte(root))
+
+	count := 0
+	err := walk(s, []Key{root}, func(key Key, block []byte) error {
+		links, err := Links(block)
+		if err == nil && len(links) == 0 {
+			links, err = LegacyLinks(s, key)
+		}
+		if err != nil {
+			return err
+		}
+		if len(links) > 0 && Hash(block) != key {
+			return ErrLegacyExport
+		}
+
+		count++
+		writeFrame(out, []byte(key))
+		return writeFrame(out, block)
+	})
+	if err != nil {
+		return err
+	}
+
+	writeFrame(out, nil)
+	writeUvarint(out, uint64(count))
+	return out.Flush()
+}
+
+func writeFrame(w *bufio.Writer, data []byte) error {
+	writeUvarint(w, uint64(len(data)))
+	_, err := w.Write(data)
+	return err
+}
+
+func writeUvarint(w *bufio.Writer, x uint64) error {
+	buf := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(buf, x)
+
+	_, err := w.Write(buf[:n])
+	return err
+}
+
+// Import puts the blocks of an archive into s, checking the hash of
+// every block and that the archive is complete, and returns the header
+// of the archive. Every truncation, inside a frame or between them, is
+// ErrTruncated. Legacy blocks, whose keys don't hash the block alone,
+// are refused with ErrHashMismatch.
+func Import(r io.Reader, s BlockStore) (Header, error) {
+	in := bufio.NewReader(r)
+
+	magic := make([]byte, len(archiveMagic))
+	n, err := io.ReadFull(in, magic)
+	if n == 0 || !bytes.Equal(magic[:n], archiveMagic[:n]) {
+		return Header{}, ErrBadArchive
+	}
+	if err != nil {
+		return Header{}, truncated(err)
+	}
+
+	version, err := in.ReadByte()
+	if err != nil {
+		return Header{}, truncated(err)
+	}
+	if version != archiveVersion {
+		return Header{}, ErrBadArchive
+	}
+
+	kind, err := in.ReadByte()
+	if err != nil {
+		return Header{}, truncated(err)
+	}
+
+	root, err := readFrame(in)
+	if err != nil {
+		return Header{}, truncated(err)
+	}
+
+	header := Header{Kind: Kind(kind), Root: Key(root)}
+	seenRoot := false
+	count := uint64(0)
+
+	for {
+		key, err := readFrame(in)
+		if err != nil {
+			return header, truncated(err)
+		}
+
+		if len(key) == 0 {
+			// the trailer
+			total, err := binary.ReadUvarint(in)
+			if err != nil {
+				return header, truncated(err)
+			}
+			if total != count {
+				return header, ErrTruncated
+			}
+			break
+		}
+		count++
+
+		block, err := readFrame(in)
+		if err != nil {
+			return header, truncated(err)
+		}
+
+		if Hash(block) != Key(key) {
+			return header, ErrHashMismatch
+		}
+
+		put, err := s.Put(block)
+		if err != nil {
+			return header, err
+		}
+		if put != Key(key) {
+			return header, fmt.Errorf("block %v was stored as %v", Key(key), put)
+		}
+
+		if Key(key) == header.Root {
+			seenRoot = true
+		}
+	}
+
+	if !seenRoot {
+		return header, ErrMissingRoot
+	}
+	return header, nil
+}
+
+// truncated tells a read cut short apart from other errors
+func truncated(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return ErrTruncated
+	}
+	return err
+}
+
+// readFrame returns io.EOF only when there is nothing left to read
+func readFrame(r *bufio.Reader) ([]byte, error) {
+	length, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if length > maxFrame {
+		return nil, ErrBadArchive
+	}
+
+	data := make([]byte, length)
+	_, err = io.ReadFull(r, data)
+	if err == io.EOF {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return data, err
+}
@@ -0,0 +1,74 @@
+package store
+
+import (
+	context "github.com/ipfs/go-ipfs/Godeps/_workspace/src/golang.org/x/net/context"
+	mdag "github.com/ipfs/go-ipfs/merkledag"
+	"strconv"
+)
+
+// DAGStore keeps blocks as the data of merkledag nodes, linking to the
+// nodes of the children of the block
+type DAGStore struct {
+	dserv mdag.DAGService
+}
+
+func NewDAGStore(dserv mdag.DAGService) *DAGStore {
+	return &DAGStore{dserv: dserv}
+}
+
+func (d *DAGStore) Put(block []byte) (Key, error) {
+	node := &mdag.Node{Data: block}
+
+	links, err := Links(block)
+	if err != nil {
+		links = nil // not a tree block, so it has no links
+	}
+	for i, link := range links {
+		node.AddRawLink(strconv.Itoa(i), &mdag.Link{Hash: []byte(link)})
+	}
+
+	_, err = d.dserv.Add(node)
+	if err != nil {
+		return "", err
+	}
+
+	link, err := mdag.MakeLink(node)
+	if err != nil {
+		return "", err
+	}
+	return Key(link.Hash), nil
+}
+
+func (d *DAGStore) Get(key Key) ([]byte, error) {
+	node, err := d.node(key)
+	if err != nil {
+		return nil, err
+	}
+	return node.Data, nil
+}
+
+// DAGLinks returns the keys the node of a block links to. Trees
+// written before blocks held the keys of their children only have
+// these links.
+func (d *DAGStore) DAGLinks(key Key) ([]Key, error) {
+	node, err := d.node(key)
+	if err != nil {
+		return nil, err
+	}
+
+	links := make([]Key, len(node.Links))
+	for i, link := range node.Links {
+		links[i] = Key(link.Hash)
+	}
+	return links, nil
+}
+
+func (d *DAGStore) node(key Key) (*mdag.Node, error) {
+	link := &mdag.Link{Hash: []byte(key)}
+
+	node, err := link.GetNode(context.Background(), d.dserv)
+	if err == mdag.ErrNotFound {
+		return nil, ErrNotFound
+	}
+	return node, err
+}
@@ -0,0 +1,131 @@
+package store
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// DirStore keeps every block in a file of its own, named by its key
+type DirStore struct {
+	path string
+}
+
+func NewDirStore(path string) (*DirStore, error) {
+	err := os.MkdirAll(path, 0755)
+	if err != nil {
+		return nil, err
+	}
+	return &DirStore{path: path}, nil
+}
+
+var ErrShortKey = errors.New("key too short to name a block")
+
+// spread the blocks over subdirectories named by the last bytes of
+// the key, the first ones are the same for all keys
+func (d *DirStore) filename(key Key) (string, error) {
+	name := key.String()
+	if len(name) < 2 {
+		return "", ErrShortKey
+	}
+	return filepath.Join(d.path, name[len(name)-2:], name), nil
+}
+
+func (d *DirStore) Put(block []byte) (Key, error) {
+	key := Hash(block)
+	name, err := d.filename(key)
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := os.Stat(name); err == nil {
+		return key, nil
+	}
+
+	err = os.MkdirAll(filepath.Dir(name), 0755)
+	if err != nil {
+		return "", err
+	}
+
+	// write and rename, so that blocks are never seen half written
+	tmp, err := ioutil.TempFile(filepath.Dir(name), "put")
+	if err != nil {
+		return "", err
+	}
+
+	_, err = tmp.Write(block)
+	if err == nil {
+		err = tmp.Close()
+	} else {
+		tmp.Close()
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), name)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	return key, nil
+}
+
+func (d *DirStore) Get(key Key) ([]byte, error) {
+	name, err := d.filename(key)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := ioutil.ReadFile(name)
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	return block, err
+}
+
+func (d *DirStore) Has(key Key) (bool, error) {
+	name, err := d.filename(key)
+	if err != nil {
+		return false, err
+	}
+
+	_, err = os.Stat(name)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (d *DirStore) Keys() ([]Key, error) {
+	keys := []Key{}
+
+	err := filepath.Walk(d.path, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+
+		// skips files being written
+		key, err := ParseKey(info.Name())
+		if err != nil {
+			return nil
+		}
+		if name, err := d.filename(key); err == nil && name == path {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	return keys, err
+}
+
+func (d *DirStore) Delete(key Key) error {
+	name, err := d.filename(key)
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(name)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,258 @@
+package store
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync"
+)
+
+// FileStore appends blocks to a single file. Every record is
+//
+//	length of the block  uint32
+//	length of the key    uint8
+//	header checksum      uint32, crc32c of the two lengths
+//	checksum             uint32, crc32c of the key and the block
+//	key
+//	block
+//
+// An index from key to offset is kept in memory and rebuilt when the
+// file is opened. A torn record at the end of the file, left by a
+// crash during a write, is truncated away: one that runs past the end
+// of the file, or ends at it with a bad checksum. Any other damaged
+// record fails the open, and the file is left as it is. A damaged
+// header gives no length, so it always fails the open.
+type FileStore struct {
+	lock  sync.RWMutex
+	file  *os.File
+	index map[Key]extent
+	end   int64
+}
+
+type extent struct {
+	offset int64
+	length uint32
+}
+
+const recordHeader = 13
+
+var fileMagic = []byte("bloomtree blocks\n")
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+var (
+	ErrBadMagic = errors.New("not a bloomtree block file")
+	ErrChecksum = errors.New("block file record checksum mismatch")
+)
+
+func OpenFileStore(path string) (*FileStore, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	f := &FileStore{
+		file:  file,
+		index: map[Key]extent{},
+	}
+
+	err = f.load()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// load checks the magic and reads the index, truncating a torn last
+// record
+func (f *FileStore) load() error {
+	info, err := f.file.Stat()
+	if err != nil {
+		return err
+	}
+
+	if info.Size() == 0 {
+		_, err = f.file.WriteAt(fileMagic, 0)
+		f.end = int64(len(fileMagic))
+		return err
+	}
+
+	magic := make([]byte, len(fileMagic))
+	_, err = f.file.ReadAt(magic, 0)
+	if err != nil || !bytes.Equal(magic, fileMagic) {
+		return ErrBadMagic
+	}
+
+	f.end = int64(len(fileMagic))
+
+	for f.end < info.Size() {
+		key, ext, next, err := f.readRecord(f.end, info.Size())
+
+		// only the last record can be torn
+		torn := err == io.ErrUnexpectedEOF || err == ErrChecksum && next == info.Size()
+		if torn {
+			return f.file.Truncate(f.end)
+		}
+		if err != nil {
+			return err
+		}
+		f.index[key] = ext
+		f.end = next
+	}
+	return nil
+}
+
+// readRecord reads and checks the record at offset. A record with a
+// bad block checksum still returns where the next one starts.
+func (f *FileStore) readRecord(offset int64, size int64) (Key, extent, int64, error) {
+	header := make([]byte, recordHeader)
+
+	if offset+recordHeader > size {
+		return "", extent{}, 0, io.ErrUnexpectedEOF
+	}
+
+	_, err := f.file.ReadAt(header, offset)
+	if err != nil {
+		return "", extent{}, 0, err
+	}
+
+	if crc32.Checksum(header[0:5], castagnoli) != binary.BigEndian.Uint32(header[5:9]) {
+		return "", extent{}, 0, ErrChecksum
+	}
+
+	length := binary.BigEndian.Uint32(header[0:4])
+	keylength := int64(header[4])
+	checksum := binary.BigEndian.Uint32(header[9:13])
+
+	next := offset + recordHeader + keylength + int64(length)
+	if next > size {
+		return "", extent{}, 0, io.ErrUnexpectedEOF
+	}
+
+	body := make([]byte, keylength+int64(length))
+	_, err = f.file.ReadAt(body, offset+recordHeader)
+	if err != nil {
+		return "", extent{}, 0, err
+	}
+
+	if crc32.Checksum(body, castagnoli) != checksum {
+		return "", extent{}, next, ErrChecksum
+	}
+
+	ext := extent{
+		offset: offset + recordHeader + keylength,
+		length: length,
+	}
+	return Key(body[:keylength]), ext, next, nil
+}
+
+func (f *FileStore) Put(block []byte) (Key, error) {
+	key := Hash(block)
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if _, ok := f.index[key]; ok {
+		return key, nil
+	}
+
+	record := make([]byte, recordHeader, recordHeader+len(key)+len(block))
+	record = append(record, key...)
+	record = append(record, block...)
+
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(block)))
+	record[4] = byte(len(key))
+	binary.BigEndian.PutUint32(record[5:9], crc32.Checksum(record[0:5], castagnoli))
+	binary.BigEndian.PutUint32(record[9:13], crc32.Checksum(record[recordHeader:], castagnoli))
+
+	_, err := f.file.WriteAt(record, f.end)
+	if err != nil {
+		return "", err
+	}
+
+	f.index[key] = extent{
+		offset: f.end + recordHeader + int64(len(key)),
+		length: uint32(len(block)),
+	}
+	f.end += int64(len(record))
+
+	return key, nil
+}
+
+func (f *FileStore) Get(key Key) ([]byte, error) {
+	f.lock.RLock()
+	ext, ok := f.index[key]
+	f.lock.RUnlock()
+
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	block := make([]byte, ext.length)
+	_, err := f.file.ReadAt(block, ext.offset)
+	if err != nil {
+		return nil, err
+	}
+	return block, nil
+}
+
+func (f *FileStore) Has(key Key) (bool, error) {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+
+	_, ok := f.index[key]
+	return ok, nil
+}
+
+// Sync flushes written blocks to disk
+func (f *FileStore) Sync() error {
+	return f.file.Sync()
+}
+
+func (f *FileStore) Close() error {
+	err := f.file.Sync()
+	if err != nil {
+		f.file.Close()
+		return err
+	}
+	return f.file.Close()
+}
+
+// Compact rewrites the block file at path, keeping only the blocks
+// reachable from the given roots. The store must not be open.
+func Compact(path string, roots []Key) error {
+	old, err := OpenFileStore(path)
+	if err != nil {
+		return err
+	}
+	defer old.Close()
+
+	tmppath := path + ".compact"
+	os.Remove(tmppath)
+
+	compacted, err := OpenFileStore(tmppath)
+	if err != nil {
+		return err
+	}
+
+	err = walk(old, roots, func(_ Key, block []byte) error {
+		_, err := compacted.Put(block)
+		return err
+	})
+
+	if err == nil {
+		err = compacted.Close()
+	} else {
+		compacted.Close()
+	}
+
+	if err != nil {
+		os.Remove(tmppath)
+		return err
+	}
+	return os.Rename(tmppath, path)
+}
@@ -0,0 +1,63 @@
+package store
+
+import (
+	"sync"
+)
+
+// MemoryStore keeps blocks in a map
+type MemoryStore struct {
+	lock   sync.RWMutex
+	blocks map[Key][]byte
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{blocks: map[Key][]byte{}}
+}
+
+func (m *MemoryStore) Put(block []byte) (Key, error) {
+	key := Hash(block)
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.blocks[key] = append([]byte{}, block...)
+	return key, nil
+}
+
+func (m *MemoryStore) Get(key Key) ([]byte, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	block, ok := m.blocks[key]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return block, nil
+}
+
+func (m *MemoryStore) Has(key Key) (bool, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	_, ok := m.blocks[key]
+	return ok, nil
+}
+
+func (m *MemoryStore) Keys() ([]Key, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	keys := make([]Key, 0, len(m.blocks))
+	for key := range m.blocks {
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+func (m *MemoryStore) Delete(key Key) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	delete(m.blocks, key)
+	return nil
+}
@@ -0,0 +1,33 @@
+// Code generated by protoc-gen-go.
+// source: block.proto
+// DO NOT EDIT!
+
+package store_pb
+
+import proto "code.google.com/p/goprotobuf/proto"
+import json "encoding/json"
+import math "math"
+
+// Reference proto, json, and math imports to suppress error if they are not otherwise used.
+var _ = proto.Marshal
+var _ = &json.SyntaxError{}
+var _ = math.Inf
+
+type Block struct {
+	Links            [][]byte `protobuf:"bytes,8,rep" json:"Links,omitempty"`
+	XXX_unrecognized []byte   `json:"-"`
+}
+
+func (m *Block) Reset()         { *m = Block{} }
+func (m *Block) String() string { return proto.CompactTextString(m) }
+func (*Block) ProtoMessage()    {}
+
+func (m *Block) GetLinks() [][]byte {
+	if m != nil {
+		return m.Links
+	}
+	return nil
+}
+
+func init() {
+}
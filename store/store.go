@@ -0,0 +1,101 @@
+package store
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"strconv"
+)
+
+// Key is the content hash of a block
+type Key string
+
+func (k Key) String() string {
+	return hex.EncodeToString([]byte(k))
+}
+
+func ParseKey(s string) (Key, error) {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return "", err
+	}
+	return Key(b), nil
+}
+
+// A BlockStore holds the blocks of persisted trees
+type BlockStore interface {
+	Put([]byte) (Key, error)
+	Get(Key) ([]byte, error)
+}
+
+var ErrNotFound = errors.New("block not found")
+
+// A DAGLinker keeps the links of a block apart from it, as merkledag
+// nodes do
+type DAGLinker interface {
+	DAGLinks(Key) ([]Key, error)
+}
+
+// LegacyLinks returns the links a store keeps apart from the block
+// with the given key. Trees written before blocks held the keys of
+// their children only link to them this way. Stores that only keep
+// blocks have no such links.
+func LegacyLinks(s BlockStore, key Key) ([]Key, error) {
+	if l, ok := s.(DAGLinker); ok {
+		return l.DAGLinks(key)
+	}
+	return nil, nil
+}
+
+// TreeLinks returns the keys of the children of the tree block with
+// the given key, from the links it holds or, if it holds none, from
+// its legacy links
+func TreeLinks(s BlockStore, key Key, links [][]byte) ([]Key, error) {
+	if len(links) == 0 {
+		return LegacyLinks(s, key)
+	}
+
+	keys := make([]Key, len(links))
+	for i, link := range links {
+		keys[i] = Key(link)
+	}
+	return keys, nil
+}
+
+// Hash returns the key of a block. It is the sha256 multihash of the
+// block wrapped in a merkledag node that links to the children of the
+// block, which is the key IPFS gives the node a DAGStore writes.
+func Hash(block []byte) Key {
+	h := sha256.New()
+	h.Write(dagNode(block))
+	return Key(append([]byte{0x12, 0x20}, h.Sum(nil)...))
+}
+
+// dagNode encodes a block as a merkledag protobuf node, the links
+// first, each named by its index and without a size
+func dagNode(block []byte) []byte {
+	links, err := Links(block)
+	if err != nil {
+		links = nil // not a tree block, so it has no links
+	}
+
+	node := []byte{}
+	for i, link := range links {
+		encoded := field(1, []byte(link))
+		encoded = append(encoded, field(2, []byte(strconv.Itoa(i)))...)
+		encoded = append(encoded, 3<<3, 0)
+
+		node = append(node, field(2, encoded)...)
+	}
+	return append(node, field(1, block)...)
+}
+
+// field encodes a length delimited protobuf field
+func field(number byte, data []byte) []byte {
+	length := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(length, uint64(len(data)))
+
+	encoded := append([]byte{number<<3 | 2}, length[:n]...)
+	return append(encoded, data...)
+}
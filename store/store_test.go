@@ -0,0 +1,569 @@
+package store
+
+import (
+	"bytes"
+	proto "code.google.com/p/goprotobuf/proto"
+	"errors"
+	"fmt"
+	mdag "github.com/ipfs/go-ipfs/merkledag"
+	pb "github.com/krl/bloomtree/store/pb"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	. "github.com/krl/bloomtree/common"
+)
+
+func testRoundtrip(t *testing.T, s BlockStore) {
+	blocks := []string{"wonk", "donk", "wonk", ""}
+
+	for _, b := range blocks {
+		key, err := s.Put([]byte(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if key != Hash([]byte(b)) {
+			t.Fatalf("Key of %q should be its hash", b)
+		}
+
+		got, err := s.Get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(got) != b {
+			t.Fatalf("Got %q back, expected %q", got, b)
+		}
+	}
+
+	_, err := s.Get(Hash([]byte("never put")))
+	if err == nil {
+		t.Fatal("Should not get a block that was never put")
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	testRoundtrip(t, NewMemoryStore())
+}
+
+func TestDirStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bloomtree")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := NewDirStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testRoundtrip(t, s)
+
+	if _, err := s.Get(""); err != ErrShortKey {
+		t.Fatalf("Should not get a block by a short key, got %v", err)
+	}
+}
+
+func TestDAGStore(t *testing.T) {
+	s := NewDAGStore(GetMockDagServ(t))
+	testRoundtrip(t, s)
+
+	// the children of a block are linked to as merkledag nodes
+	leaf := linking(t, s, "leaf")
+	root := linking(t, s, "root", leaf, leaf)
+
+	links, err := LegacyLinks(s, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(links) != 2 || links[0] != leaf || links[1] != leaf {
+		t.Fatalf("Should link to the children, got %v", links)
+	}
+
+	block, err := s.Get(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if Hash(block) != root {
+		t.Fatal("Key of a linking block should be its hash")
+	}
+}
+
+func TestParseKey(t *testing.T) {
+	key := Hash([]byte("wonk"))
+
+	parsed, err := ParseKey(key.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if parsed != key {
+		t.Fatal("Should parse the key back")
+	}
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "bloomtree")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// makes a block linking to children
+func linking(t *testing.T, s BlockStore, data string, children ...Key) Key {
+	message := &pb.Block{}
+	for _, c := range children {
+		message.Links = append(message.Links, []byte(c))
+	}
+
+	block, _ := proto.Marshal(message)
+
+	// data as an unknown field, like the rest of a tree block
+	buf := proto.NewBuffer(block)
+	buf.EncodeVarint(3<<3 | 2)
+	buf.EncodeRawBytes([]byte(data))
+
+	key, err := s.Put(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestFileStore(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	s, err := OpenFileStore(filepath.Join(dir, "blocks"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	testRoundtrip(t, s)
+}
+
+func TestFileStoreTornTail(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "blocks")
+
+	s, err := OpenFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, _ := s.Put([]byte("wonk"))
+	s.Close()
+
+	// a half written record
+	file, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	file.Write([]byte{0, 0, 0, 4, 1, 2})
+	file.Close()
+
+	s, err = OpenFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	block, err := s.Get(key)
+	if err != nil || string(block) != "wonk" {
+		t.Fatal("Should keep the blocks before the torn record")
+	}
+
+	key, _ = s.Put([]byte("donk"))
+	s.Close()
+
+	s, _ = OpenFileStore(path)
+	defer s.Close()
+
+	block, err = s.Get(key)
+	if err != nil || string(block) != "donk" {
+		t.Fatal("Should write after the truncated tail")
+	}
+}
+
+func TestFileStoreCorrupt(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "blocks")
+
+	s, err := OpenFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, _ := s.Put([]byte("wonk"))
+	s.Put([]byte("donk"))
+	s.Close()
+
+	// damage the first block, so the checksum fails mid-file
+	offset := s.index[key].offset
+	file, _ := os.OpenFile(path, os.O_WRONLY, 0644)
+	file.WriteAt([]byte("v"), offset)
+	file.Close()
+
+	before, _ := ioutil.ReadFile(path)
+
+	_, err = OpenFileStore(path)
+	if err != ErrChecksum {
+		t.Fatalf("Should fail to open a damaged file, got %v", err)
+	}
+
+	after, _ := ioutil.ReadFile(path)
+	if !bytes.Equal(before, after) {
+		t.Fatal("Should leave a damaged file as it is")
+	}
+}
+
+func TestFileStoreCorruptLength(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "blocks")
+
+	s, err := OpenFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.Put([]byte("wonk"))
+	s.Put([]byte("donk"))
+	s.Close()
+
+	// a length running past the end must not drop the blocks after it
+	file, _ := os.OpenFile(path, os.O_WRONLY, 0644)
+	file.WriteAt([]byte{0xff}, int64(len(fileMagic)))
+	file.Close()
+
+	before, _ := ioutil.ReadFile(path)
+
+	_, err = OpenFileStore(path)
+	if err != ErrChecksum {
+		t.Fatalf("Should fail to open a file with a damaged header, got %v", err)
+	}
+
+	after, _ := ioutil.ReadFile(path)
+	if !bytes.Equal(before, after) {
+		t.Fatal("Should leave a damaged file as it is")
+	}
+}
+
+func TestFileStoreTornChecksum(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "blocks")
+
+	s, err := OpenFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, _ := s.Put([]byte("wonk"))
+	last, _ := s.Put([]byte("donk"))
+	s.Close()
+
+	// the last record is all there, but not as written
+	file, _ := os.OpenFile(path, os.O_WRONLY, 0644)
+	file.WriteAt([]byte("v"), s.index[last].offset)
+	file.Close()
+
+	s, err = OpenFileStore(path)
+	if err != nil {
+		t.Fatalf("Should truncate a torn last record, got %v", err)
+	}
+	defer s.Close()
+
+	if block, err := s.Get(first); err != nil || string(block) != "wonk" {
+		t.Fatal("Should keep the blocks before the torn record")
+	}
+	if _, err := s.Get(last); err != ErrNotFound {
+		t.Fatal("Should drop the torn record")
+	}
+}
+
+func TestCompact(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "blocks")
+
+	s, err := OpenFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	leaf := linking(t, s, "leaf")
+	root := linking(t, s, "root", leaf)
+	orphan := linking(t, s, "orphan", leaf)
+	s.Close()
+
+	err = Compact(path, []Key{root})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, _ = OpenFileStore(path)
+	defer s.Close()
+
+	for _, key := range []Key{root, leaf} {
+		if _, err := s.Get(key); err != nil {
+			t.Fatal("Should keep reachable blocks")
+		}
+	}
+
+	if _, err := s.Get(orphan); err != ErrNotFound {
+		t.Fatal("Should drop unreachable blocks")
+	}
+}
+
+func testGC(t *testing.T, s Collectable) {
+	leaf := linking(t, s, "leaf")
+	old := linking(t, s, "old", leaf)
+	new := linking(t, s, "new", leaf)
+
+	deleted, err := GC(s, []Key{new})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if deleted != 1 {
+		t.Fatalf("Should have deleted 1 block, deleted %v", deleted)
+	}
+
+	if _, err := s.Get(old); err != ErrNotFound {
+		t.Fatal("Should have deleted the old root")
+	}
+
+	keys, _ := s.Keys()
+	if len(keys) != 2 {
+		t.Fatalf("Should have 2 blocks left, has %v", len(keys))
+	}
+
+	// a missing block stops the collection
+	s.Delete(leaf)
+
+	if _, err := GC(s, []Key{new}); err == nil {
+		t.Fatal("Should fail when live blocks are missing")
+	}
+
+	if _, err := s.Get(new); err != nil {
+		t.Fatal("Should not delete anything when failing")
+	}
+}
+
+func TestMemoryStoreGC(t *testing.T) {
+	testGC(t, NewMemoryStore())
+}
+
+func TestDirStoreGC(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	s, err := NewDirStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testGC(t, s)
+}
+
+func TestReachable(t *testing.T) {
+	s := NewMemoryStore()
+
+	leaf := linking(t, s, "leaf")
+	left := linking(t, s, "left", leaf)
+	right := linking(t, s, "right", leaf)
+	root := linking(t, s, "root", left, right)
+	linking(t, s, "orphan", root)
+
+	keys, errs := Reachable(s, root)
+
+	found := map[Key]bool{}
+	for key := range keys {
+		found[key] = true
+	}
+
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+
+	if len(found) != 4 {
+		t.Fatalf("Should reach 4 blocks, reached %v", len(found))
+	}
+
+	_, errs = Reachable(s, Hash([]byte("missing")))
+
+	if <-errs != ErrNotFound {
+		t.Fatal("Should report missing blocks")
+	}
+}
+
+// fails every put after the first few
+type failingStore struct {
+	BlockStore
+	lock sync.Mutex
+	puts int
+}
+
+func (f *failingStore) Put(block []byte) (Key, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.puts == 0 {
+		return "", errors.New("interrupted")
+	}
+	f.puts--
+	return f.BlockStore.Put(block)
+}
+
+func TestSync(t *testing.T) {
+	src := NewDAGStore(GetMockDagServ(t))
+	dst := NewDAGStore(GetMockDagServ(t))
+
+	// a binary tree of 31 blocks
+	level := []Key{}
+	for i := 0; i < 16; i++ {
+		level = append(level, linking(t, src, fmt.Sprintf("leaf %v", i)))
+	}
+	for len(level) > 1 {
+		parents := []Key{}
+		for i := 0; i < len(level); i += 2 {
+			parents = append(parents, linking(t, src, "node", level[i], level[i+1]))
+		}
+		level = parents
+	}
+	root := level[0]
+
+	_, err := Sync(root, src, &failingStore{BlockStore: dst, puts: 10}, 4)
+	if err == nil {
+		t.Fatal("Should report the interruption")
+	}
+
+	stats, err := Sync(root, src, dst, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stats.Copied != 21 {
+		t.Fatalf("Should copy the 21 blocks left, copied %v", stats.Copied)
+	}
+
+	keys, errs := Reachable(dst, root)
+	count := 0
+	for _ = range keys {
+		count++
+	}
+
+	if err := <-errs; err != nil || count != 31 {
+		t.Fatalf("Should have all 31 blocks after syncing, has %v", count)
+	}
+
+	stats, _ = Sync(root, src, dst, 4)
+
+	if stats.Copied != 0 || stats.Skipped != 1 {
+		t.Fatal("Should skip everything when synced")
+	}
+
+	// a block linked to twice is copied once
+	leaf := linking(t, src, "shared")
+	root = linking(t, src, "root", linking(t, src, "left", leaf), linking(t, src, "right", leaf))
+
+	stats, err = Sync(root, src, NewMemoryStore(), 8)
+	if err != nil || stats.Copied != 4 {
+		t.Fatalf("Should copy 4 blocks, copied %v", stats.Copied)
+	}
+}
+
+func TestSyncLegacy(t *testing.T) {
+	dserv := GetMockDagServ(t)
+	src := NewDAGStore(dserv)
+
+	// written before blocks held their links, with only data
+	block := func(data string) []byte {
+		buf := proto.NewBuffer(nil)
+		buf.EncodeVarint(3<<3 | 2)
+		buf.EncodeRawBytes([]byte(data))
+		return buf.Bytes()
+	}
+	leaves := []*mdag.Node{{Data: block("wonk")}, {Data: block("donk")}}
+	root := &mdag.Node{Data: block("root")}
+	for i, leaf := range leaves {
+		if _, err := dserv.Add(leaf); err != nil {
+			t.Fatal(err)
+		}
+		link, _ := mdag.MakeLink(leaf)
+		root.AddRawLink(fmt.Sprint(i), link)
+	}
+	if _, err := dserv.Add(root); err != nil {
+		t.Fatal(err)
+	}
+	link, _ := mdag.MakeLink(root)
+	key := Key(link.Hash)
+
+	dst := NewDAGStore(GetMockDagServ(t))
+	stats, err := Sync(key, src, dst, 2)
+	if err != nil || stats.Copied != 3 {
+		t.Fatalf("Should copy the 3 blocks of a legacy tree, copied %v: %v", stats.Copied, err)
+	}
+	if links, _ := dst.DAGLinks(key); len(links) != 2 {
+		t.Fatal("Should keep the links of legacy blocks")
+	}
+
+	if _, err := Sync(key, src, NewMemoryStore(), 2); err != ErrLegacyCopy {
+		t.Fatalf("Should refuse to copy legacy blocks out of DAG stores, got %v", err)
+	}
+
+	if err := Export(&bytes.Buffer{}, src, key, KindSet); err != ErrLegacyExport {
+		t.Fatalf("Should refuse to export legacy blocks, got %v", err)
+	}
+}
+
+func TestArchiveTruncated(t *testing.T) {
+	s := NewMemoryStore()
+	leaf := linking(t, s, "leaf")
+	root := linking(t, s, "root", leaf, linking(t, s, "node", leaf))
+
+	var archive bytes.Buffer
+	err := Export(&archive, s, root, KindSet)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	header, err := Import(bytes.NewReader(archive.Bytes()), NewMemoryStore())
+	if err != nil || header.Root != root {
+		t.Fatalf("Should import the whole archive, got %v", err)
+	}
+
+	// cut off between frames, leaving out the two byte trailer
+	cut := archive.Bytes()[:archive.Len()-2]
+
+	_, err = Import(bytes.NewReader(cut), NewMemoryStore())
+	if err != ErrTruncated {
+		t.Fatalf("Should refuse a truncated archive, got %v", err)
+	}
+
+	// a trailer counting more blocks than were read
+	miscounted := append(append([]byte{}, cut...), 0, 4)
+
+	_, err = Import(bytes.NewReader(miscounted), NewMemoryStore())
+	if err != ErrTruncated {
+		t.Fatalf("Should refuse an archive missing blocks, got %v", err)
+	}
+
+	// cut off at every byte, in the middle of frames or between them
+	for n := 1; n < archive.Len(); n++ {
+		_, err = Import(bytes.NewReader(archive.Bytes()[:n]), NewMemoryStore())
+		if err != ErrTruncated {
+			t.Fatalf("Should refuse an archive cut at %v of %v bytes, got %v", n, archive.Len(), err)
+		}
+	}
+}
@@ -0,0 +1,217 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+)
+
+// A Haser can tell if it holds a block without reading it
+type Haser interface {
+	Has(Key) (bool, error)
+}
+
+// Has tells if s holds the block with the given key, reading it if s
+// is not a Haser
+func Has(s BlockStore, key Key) (bool, error) {
+	if h, ok := s.(Haser); ok {
+		return h.Has(key)
+	}
+
+	_, err := s.Get(key)
+	if err == ErrNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+var ErrLegacyCopy = errors.New("legacy blocks can only be copied between DAG stores")
+
+type SyncStats struct {
+	Copied  int
+	Skipped int
+}
+
+// Sync copies the blocks reachable from root that are missing in dst
+// from src, using a pool of workers for the store operations.
+// Subtrees whose root block is already in dst are skipped. A block is
+// only written after all of its children, so a Sync that was
+// interrupted picks up where it left off when run again. Blocks of
+// trees written before blocks held their links are copied with the
+// merkledag nodes that link them, so only between DAG stores.
+func Sync(root Key, src, dst BlockStore, workers int) (SyncStats, error) {
+	if workers < 1 {
+		workers = 1
+	}
+
+	jobs := make(chan syncJob)
+	results := make(chan syncResult)
+
+	for i := 0; i < workers; i++ {
+		go func() {
+			for job := range jobs {
+				results <- job.run(src, dst)
+			}
+		}()
+	}
+
+	stats := SyncStats{}
+	var err error
+
+	// blocks waiting for their children to be written, the parents
+	// waiting for each child, and the blocks done with
+	pending := map[Key]*pendingBlock{}
+	parents := map[Key][]Key{}
+	seen := map[Key]bool{root: true}
+	done := map[Key]bool{}
+
+	// a stack, so that the tree is copied depth first and few
+	// blocks are pending at a time
+	queue := []syncJob{{key: root}}
+	running := 0
+
+	finish := func(key Key) {
+		done[key] = true
+		for _, parent := range parents[key] {
+			p := pending[parent]
+			p.missing--
+			if p.missing == 0 {
+				queue = append(queue, syncJob{key: parent, block: p.block, legacy: p.legacy})
+				delete(pending, parent)
+			}
+		}
+		delete(parents, key)
+	}
+
+	for running > 0 || (len(queue) > 0 && err == nil) {
+		var next chan<- syncJob
+		var job syncJob
+
+		// stop handing out work after an error
+		if len(queue) > 0 && err == nil {
+			next = jobs
+			job = queue[len(queue)-1]
+		}
+
+		select {
+		case next <- job:
+			queue = queue[:len(queue)-1]
+			running++
+
+		case result := <-results:
+			running--
+
+			switch {
+			case result.err != nil:
+				if err == nil {
+					err = result.err
+				}
+			case result.present:
+				stats.Skipped++
+				finish(result.key)
+			case result.block != nil:
+				p := &pendingBlock{block: result.block, legacy: result.legacy}
+				for _, link := range result.links {
+					if done[link] {
+						continue
+					}
+					parents[link] = append(parents[link], result.key)
+					p.missing++
+
+					if !seen[link] {
+						seen[link] = true
+						queue = append(queue, syncJob{key: link})
+					}
+				}
+
+				if p.missing == 0 {
+					queue = append(queue, syncJob{key: result.key, block: result.block, legacy: result.legacy})
+				} else {
+					pending[result.key] = p
+				}
+			default:
+				stats.Copied++
+				finish(result.key)
+			}
+		}
+	}
+
+	close(jobs)
+	return stats, err
+}
+
+// a syncJob reads a block missing in dst, or writes it when the block
+// is given
+type syncJob struct {
+	key    Key
+	block  []byte
+	legacy bool
+}
+
+// the result of a read has the block and its links, that of a write
+// has neither
+type syncResult struct {
+	key     Key
+	present bool
+	block   []byte
+	links   []Key
+	legacy  bool
+	err     error
+}
+
+type pendingBlock struct {
+	block   []byte
+	legacy  bool
+	missing int
+}
+
+func (job syncJob) run(src, dst BlockStore) syncResult {
+	result := syncResult{key: job.key}
+
+	if job.block != nil && job.legacy {
+		result.err = copyLegacy(src, dst, job.key)
+		return result
+	}
+
+	if job.block != nil {
+		put, err := dst.Put(job.block)
+		if err == nil && put != job.key {
+			err = fmt.Errorf("block %v was stored as %v", job.key, put)
+		}
+		result.err = err
+		return result
+	}
+
+	result.present, result.err = Has(dst, job.key)
+	if result.err != nil || result.present {
+		return result
+	}
+
+	result.block, result.err = src.Get(job.key)
+	if result.err != nil {
+		return result
+	}
+
+	result.links, result.err = Links(result.block)
+	if result.err == nil && len(result.links) == 0 {
+		result.links, result.err = LegacyLinks(src, job.key)
+		result.legacy = len(result.links) > 0
+	}
+	return result
+}
+
+// copyLegacy copies a block written before blocks held their links,
+// with the merkledag node that links it to its children
+func copyLegacy(src, dst BlockStore, key Key) error {
+	from, ok := src.(*DAGStore)
+	to, ok2 := dst.(*DAGStore)
+	if !ok || !ok2 {
+		return ErrLegacyCopy
+	}
+
+	node, err := from.node(key)
+	if err != nil {
+		return err
+	}
+	_, err = to.dserv.Add(node)
+	return err
+}
@@ -0,0 +1,123 @@
+package store
+
+import (
+	proto "code.google.com/p/goprotobuf/proto"
+	pb "github.com/krl/bloomtree/store/pb"
+)
+
+// Links returns the keys of the children of a bloomseq or bloomset
+// tree block
+func Links(block []byte) ([]Key, error) {
+	message := new(pb.Block)
+
+	err := proto.Unmarshal(block, message)
+	if err != nil {
+		return nil, err
+	}
+
+	links := make([]Key, len(message.Links))
+	for i, link := range message.Links {
+		links[i] = Key(link)
+	}
+	return links, nil
+}
+
+// walk calls fn once for every block reachable from the roots, before
+// visiting its children
+func walk(s BlockStore, roots []Key, fn func(Key, []byte) error) error {
+	seen := map[Key]bool{}
+	stack := append([]Key{}, roots...)
+
+	for len(stack) > 0 {
+		key := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+
+		block, err := s.Get(key)
+		if err != nil {
+			return err
+		}
+
+		err = fn(key, block)
+		if err != nil {
+			return err
+		}
+
+		links, err := Links(block)
+		if err == nil && len(links) == 0 {
+			links, err = LegacyLinks(s, key)
+		}
+		if err != nil {
+			return err
+		}
+		stack = append(stack, links...)
+	}
+	return nil
+}
+
+// Reachable streams the key of every block reachable from root. When
+// the walk fails, the error is sent on the error channel before both
+// channels are closed.
+func Reachable(s BlockStore, root Key) (<-chan Key, <-chan error) {
+	keys := make(chan Key)
+	errs := make(chan error, 1)
+
+	go func() {
+		err := walk(s, []Key{root}, func(key Key, _ []byte) error {
+			keys <- key
+			return nil
+		})
+		if err != nil {
+			errs <- err
+		}
+		close(keys)
+		close(errs)
+	}()
+
+	return keys, errs
+}
+
+// A Collectable store can list and delete its blocks
+type Collectable interface {
+	BlockStore
+	Keys() ([]Key, error)
+	Delete(Key) error
+}
+
+// GC deletes every block that is not reachable from one of the live
+// roots and returns how many were deleted. Nothing is deleted if
+// any of the reachable blocks can't be read.
+func GC(s Collectable, liveRoots []Key) (int, error) {
+	live := map[Key]bool{}
+
+	err := walk(s, liveRoots, func(key Key, _ []byte) error {
+		live[key] = true
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	keys, err := s.Keys()
+	if err != nil {
+		return 0, err
+	}
+
+	deleted := 0
+	for _, key := range keys {
+		if live[key] {
+			continue
+		}
+
+		err = s.Delete(key)
+		if err != nil {
+			return deleted, err
+		}
+		deleted++
+	}
+	return deleted, nil
+}